@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	vm "github.com/rthornton128/vm/lib"
+)
+
+var (
+	create  = flag.Bool("c", false, "add objects to the archive, creating it if needed")
+	del     = flag.Bool("d", false, "delete members from the archive")
+	list    = flag.Bool("t", false, "list the members of the archive")
+	extract = flag.Bool("x", false, "extract members, or all of them if none are named")
+	verbose = flag.Bool("v", false, "list sizes and the symbol index too")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: ar -c|-d|-t|-x [-v] archive [file...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	n := 0
+	for _, b := range []bool{*create, *del, *list, *extract} {
+		if b {
+			n++
+		}
+	}
+	if n != 1 || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	name, files := flag.Arg(0), flag.Args()[1:]
+
+	a := vm.NewArchive()
+	b, err := ioutil.ReadFile(name)
+	switch {
+	case err == nil:
+		if a, err = vm.ScanArchive(b); err != nil {
+			log.Fatalf("%s: %s", name, err)
+		}
+	case !os.IsNotExist(err) || !*create:
+		log.Fatal(err)
+	}
+
+	switch {
+	case *create:
+		for _, fname := range files {
+			b, err := ioutil.ReadFile(fname)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := a.Add(filepath.Base(fname), b); err != nil {
+				log.Fatal(err)
+			}
+		}
+		write(name, a)
+	case *del:
+		for _, fname := range files {
+			if err := a.Remove(fname); err != nil {
+				log.Fatal(err)
+			}
+		}
+		write(name, a)
+	case *list:
+		for _, m := range a.Members {
+			if *verbose {
+				fmt.Printf("%6d %s\n", len(m.Data), m.Name)
+			} else {
+				fmt.Println(m.Name)
+			}
+		}
+		if *verbose {
+			fmt.Println("\nIndex:")
+			for _, e := range a.Index {
+				fmt.Printf("  %-16s %s\n", e.Name, a.Members[e.Member].Name)
+			}
+		}
+	case *extract:
+		want := make(map[string]bool)
+		for _, fname := range files {
+			want[fname] = true
+		}
+		for _, m := range a.Members {
+			if len(files) > 0 && !want[m.Name] {
+				continue
+			}
+			delete(want, m.Name)
+			// members are only ever extracted into the current directory
+			if m.Name != filepath.Base(m.Name) || m.Name == ".." {
+				log.Fatal("invalid member name: ", m.Name)
+			}
+			if *verbose {
+				fmt.Println("x -", m.Name)
+			}
+			if err := ioutil.WriteFile(m.Name, m.Data, 0644); err != nil {
+				log.Fatal(err)
+			}
+		}
+		for fname := range want {
+			log.Fatal("no such member: ", fname)
+		}
+	}
+}
+
+func write(name string, a *vm.Archive) {
+	if err := ioutil.WriteFile(name, a.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
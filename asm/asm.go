@@ -4,32 +4,45 @@ import (
 	"bytes"
 	"flag"
 	"go/token"
+	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 
 	vm "github.com/rthornton128/vm/lib"
 )
 
 func main() {
+	listing := flag.Bool("l", false, "write a listing of the source with "+
+		"the address and bytes of each line to a .lst file")
 	flag.Parse()
 
-	in, err := os.Open(flag.Arg(0))
+	src, err := ioutil.ReadFile(flag.Arg(0))
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer in.Close()
 
 	// encoding
 	fset := token.NewFileSet()
-	info, err := in.Stat()
-	if err != nil {
-		log.Fatal(err)
-	}
-	f := fset.AddFile(flag.Arg(0), -1, int(info.Size()))
+	f := fset.AddFile(flag.Arg(0), -1, len(src))
 	buf := new(bytes.Buffer)
 	e := vm.NewEncoder(f, buf)
-	if err := e.Encode(in); err != nil {
-		log.Fatal(err)
+	if err := e.Encode(bytes.NewReader(src)); err != nil {
+		vm.PrintError(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *listing {
+		lst, err := os.Create(strings.TrimSuffix(flag.Arg(0), ".a") + ".lst")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := e.Listing(lst, src); err != nil {
+			log.Fatal(err)
+		}
+		if err := lst.Close(); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	out, err := os.Create(flag.Arg(0) + ".o") // TODO fix extention handling
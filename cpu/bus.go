@@ -0,0 +1,110 @@
+package cpu
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Device is a memory mapped peripheral. Addresses passed to a device are
+// offsets from the base address it is mapped at.
+type Device interface {
+	Memory
+	Size() uint16 // number of addresses the device occupies
+}
+
+// Ticker is implemented by devices which advance with the CPU, such as
+// timers. Tick is called after each instruction with the number of clock
+// cycles it took.
+type Ticker interface {
+	Tick(cycles int)
+}
+
+// Interrupter is implemented by devices which can request interrupts.
+// Connect is called with the function the device calls to raise its
+// interrupt line.
+type Interrupter interface {
+	Connect(raise func())
+}
+
+type mapping struct {
+	name string
+	base uint16
+	dev  Device
+}
+
+// Bus is a Memory which routes addresses to the devices mapped at them.
+// Addresses not mapped to any device go to RAM.
+type Bus struct {
+	ram  Memory
+	maps []mapping // sorted by base address
+}
+
+func NewBus(ram Memory) *Bus {
+	return &Bus{ram: ram}
+}
+
+// Map maps dev at base. Devices may not overlap one another.
+func (b *Bus) Map(name string, base uint16, dev Device) error {
+	end := uint32(base) + uint32(dev.Size())
+	if end > 0x10000 {
+		return fmt.Errorf("%s: device at %04x exceeds address space", name, base)
+	}
+	for _, m := range b.maps {
+		if uint32(base) < uint32(m.base)+uint32(m.dev.Size()) && end > uint32(m.base) {
+			return fmt.Errorf("%s: device at %04x overlaps %s at %04x", name,
+				base, m.name, m.base)
+		}
+	}
+	b.maps = append(b.maps, mapping{name: name, base: base, dev: dev})
+	sort.Slice(b.maps, func(i, j int) bool {
+		return b.maps[i].base < b.maps[j].base
+	})
+	return nil
+}
+
+func (b *Bus) lookup(addr uint16) (Memory, uint16) {
+	for _, m := range b.maps {
+		if addr >= m.base && uint32(addr) < uint32(m.base)+uint32(m.dev.Size()) {
+			return m.dev, addr - m.base
+		}
+	}
+	return b.ram, addr
+}
+
+func (b *Bus) Fetch(addr uint16) byte {
+	m, off := b.lookup(addr)
+	return m.Fetch(off)
+}
+
+func (b *Bus) Write(addr uint16, data byte) {
+	m, off := b.lookup(addr)
+	m.Write(off, data)
+}
+
+// Tick advances every device which implements Ticker
+func (b *Bus) Tick(cycles int) {
+	for _, m := range b.maps {
+		if t, ok := m.dev.(Ticker); ok {
+			t.Tick(cycles)
+		}
+	}
+}
+
+// DeviceBase returns the lowest address a device is mapped at, or 0xffff if
+// there are no devices
+func (b *Bus) DeviceBase() uint16 {
+	if len(b.maps) == 0 {
+		return 0xffff
+	}
+	return b.maps[0].base
+}
+
+// Devices returns the name and base address of each mapped device
+func (b *Bus) Devices() []string {
+	s := make([]string, len(b.maps))
+	for i, m := range b.maps {
+		s[i] = fmt.Sprintf("%04x-%04x %s", m.base,
+			uint32(m.base)+uint32(m.dev.Size())-1, m.name)
+	}
+	return s
+}
@@ -0,0 +1,212 @@
+package cpu_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rthornton128/vm/cpu"
+)
+
+// block is a device backed by memory which counts the cycles it is ticked
+type block struct {
+	cpu.StdMemory
+	cycles int
+}
+
+func (b *block) Size() uint16 {
+	return uint16(len(b.StdMemory))
+}
+
+func (b *block) Tick(cycles int) {
+	b.cycles += cycles
+}
+
+func TestBusMap(t *testing.T) {
+	bus := cpu.NewBus(cpu.NewBlock(0))
+	if bus.DeviceBase() != 0xffff {
+		t.Fatal("expected no devices, got base", bus.DeviceBase())
+	}
+	var tests = []struct {
+		name string
+		base uint16
+		size uint16
+		err  string
+	}{
+		{"a", 0xff00, 4, ""},
+		{"b", 0xff04, 2, ""},
+		{"c", 0xfe00, 0x100, ""},
+		{"d", 0xff03, 1, "d: device at ff03 overlaps a at ff00"},
+		{"e", 0xfeff, 2, "e: device at feff overlaps c at fe00"},
+		{"f", 0xff05, 4, "f: device at ff05 overlaps b at ff04"},
+		{"g", 0xfffe, 4, "g: device at fffe exceeds address space"},
+		{"h", 0xfffc, 4, ""},
+	}
+	for _, test := range tests {
+		err := bus.Map(test.name, test.base, &block{StdMemory: cpu.NewBlock(test.size)})
+		switch {
+		case test.err == "" && err != nil:
+			t.Fatal(test.name, "expected no error, got", err)
+		case test.err != "" && (err == nil || err.Error() != test.err):
+			t.Fatal(test.name, "expected error", test.err, "got", err)
+		}
+	}
+	if bus.DeviceBase() != 0xfe00 {
+		t.Fatal("expected device base fe00, got", bus.DeviceBase())
+	}
+	expect := "fe00-feff c,ff00-ff03 a,ff04-ff05 b,fffc-ffff h"
+	if s := strings.Join(bus.Devices(), ","); s != expect {
+		t.Fatal("expected devices", expect, "got", s)
+	}
+}
+
+func TestBusRouting(t *testing.T) {
+	ram := cpu.NewBlock(0)
+	bus := cpu.NewBus(ram)
+	dev := &block{StdMemory: cpu.NewBlock(4)}
+	if err := bus.Map("dev", 0x1000, dev); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []uint16{0x0fff, 0x1000, 0x1003, 0x1004} {
+		bus.Write(addr, byte(addr))
+	}
+	if ram[0x0fff] != 0xff || ram[0x1004] != 0x04 {
+		t.Fatal("expected addresses either side of the device to reach RAM")
+	}
+	if ram[0x1000] != 0 || ram[0x1003] != 0 {
+		t.Fatal("expected device addresses not to reach RAM")
+	}
+	if dev.StdMemory[0] != 0x00 || dev.StdMemory[3] != 0x03 {
+		t.Fatal("expected device to be written at its offsets, got",
+			dev.StdMemory)
+	}
+	dev.StdMemory[1] = 0x42
+	if b := bus.Fetch(0x1001); b != 0x42 {
+		t.Fatal("expected 0x42 from device, got", b)
+	}
+	bus.Tick(7)
+	bus.Tick(4)
+	if dev.cycles != 11 {
+		t.Fatal("expected device to be ticked 11 cycles, got", dev.cycles)
+	}
+}
+
+func TestTimer(t *testing.T) {
+	var tm cpu.Timer
+	raised := 0
+	tm.Connect(func() { raised++ })
+	count := func() uint16 {
+		hi := tm.Fetch(0)
+		return uint16(hi)<<8 | uint16(tm.Fetch(1))
+	}
+
+	tm.Tick(15)
+	if count() != 0 {
+		t.Fatal("expected no count before 16 cycles, got", count())
+	}
+	tm.Tick(1 + 16*0x1ff)
+	if count() != 0x200 || raised != 0 {
+		t.Fatal("expected count 0x200 without interrupts, got", count(), raised)
+	}
+
+	// the low byte is latched when the high byte is read
+	hi := tm.Fetch(0)
+	tm.Tick(16)
+	if lo := tm.Fetch(1); hi != 0x02 || lo != 0x00 {
+		t.Fatalf("expected latched count 0200, got %02x%02x", hi, lo)
+	}
+
+	tm.Write(1, 0xff)
+	if count() != 0 {
+		t.Fatal("expected write to reset the count, got", count())
+	}
+	tm.Write(2, 3)
+	tm.Write(3, 1)
+	if tm.Fetch(2) != 3 || tm.Fetch(3) != 1 {
+		t.Fatal("expected divider and control to read back")
+	}
+	tm.Tick(63)
+	if count() != 0 || raised != 0 {
+		t.Fatal("expected no count before 64 cycles, got", count(), raised)
+	}
+	tm.Tick(1 + 64)
+	if count() != 2 || raised != 2 {
+		t.Fatal("expected 2 counts and interrupts, got", count(), raised)
+	}
+}
+
+func TestRandom(t *testing.T) {
+	read := func(r *cpu.Random) []byte {
+		b := make([]byte, 8)
+		for i := range b {
+			b[i] = r.Fetch(0)
+		}
+		return b
+	}
+	r1, r2 := cpu.NewRandom(1), cpu.NewRandom(1)
+	b := read(r1)
+	if !bytes.Equal(b, read(r2)) {
+		t.Fatal("expected generators with the same seed to agree")
+	}
+	if bytes.Equal(b, read(r1)) {
+		t.Fatal("expected generator to return new bytes, got", b)
+	}
+	r1.Write(0, 7)
+	r2.Write(0, 7)
+	if !bytes.Equal(read(r1), read(r2)) {
+		t.Fatal("expected reseeded generators to agree")
+	}
+}
+
+func TestConsole(t *testing.T) {
+	out := new(bytes.Buffer)
+	con := cpu.NewConsole(strings.NewReader("hi"), out)
+	con.Write(0, 'o')
+	con.Write(0, 'k')
+	if out.String() != "ok" {
+		t.Fatal("expected ok to be output, got", out.String())
+	}
+	for _, c := range []byte("hi") {
+		if b := con.Fetch(0); b != c {
+			t.Fatalf("expected %q, got %q", c, b)
+		}
+	}
+	if b := con.Fetch(0); b != 0 {
+		t.Fatal("expected 0 at end of input, got", b)
+	}
+	if st := con.Fetch(1); st != 0x1 {
+		t.Fatal("expected status 0x1 at end of input, got", st)
+	}
+}
+
+func TestConsoleInterrupt(t *testing.T) {
+	con := cpu.NewConsole(strings.NewReader("x"), new(bytes.Buffer))
+	raised := 0
+	con.Connect(func() { raised++ })
+	con.Tick(4)
+	if raised != 0 {
+		t.Fatal("expected no interrupt before it is enabled")
+	}
+	con.Write(2, 1)
+	if con.Fetch(2) != 1 {
+		t.Fatal("expected control to read back")
+	}
+	for deadline := time.Now().Add(time.Second); raised == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected an interrupt once input is ready")
+		}
+		time.Sleep(time.Millisecond)
+		con.Tick(4)
+	}
+	if st := con.Fetch(1); st != 0x2 {
+		t.Fatal("expected status 0x2 while a character is ready, got", st)
+	}
+	con.Tick(4)
+	if raised != 1 {
+		t.Fatal("expected one interrupt per character, got", raised)
+	}
+	if b := con.Fetch(0); b != 'x' {
+		t.Fatalf("expected 'x', got %q", b)
+	}
+}
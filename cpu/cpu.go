@@ -0,0 +1,698 @@
+// Package cpu emulates the virtual machine's processor along with its
+// memory, interrupt controller and memory mapped devices.
+package cpu
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	vm "github.com/rthornton128/vm/lib"
+)
+
+// Reason is the reason the CPU stopped running
+type Reason int
+
+const (
+	Running  Reason = iota
+	Halted          // executed hlt with interrupts disabled
+	Returned        // returned from the entry point
+	Faulted         // stopped by a fault
+)
+
+var reasons = []string{
+	Running:  "running",
+	Halted:   "halted",
+	Returned: "returned",
+	Faulted:  "faulted",
+}
+
+func (r Reason) String() string {
+	return reasons[r]
+}
+
+const (
+	// waitCycles is the number of cycles a step takes while the CPU is
+	// halted waiting for an interrupt
+	waitCycles = 4
+
+	// interruptCycles is the number of cycles taken to accept an interrupt
+	interruptCycles = 13
+)
+
+// CPU is the virtual machine's processor. It is created ready to run a
+// program with New and executes it with Step or Run.
+type CPU struct {
+	ar  uint16 // address register
+	dr  byte   // data register
+	ir  byte   // instruction register
+	pc  uint16 // program counter
+	sp  uint16 // stack pointer
+	tr  byte   // temporary register
+	ac  byte   // accumulator
+	b   byte   // register b
+	c   byte   // register c
+	fl  Flags  // status flags
+	ie  bool   // interrupts enabled
+	eid bool   // interrupts enabled after the next instruction
+	iv  uint16 // interrupt vector table address
+	irq *Interrupts
+	mem Memory
+
+	sb uint16 // stack base, the lowest address of the stack
+	ss uint16 // stack size, 0 if it may grow up to the devices
+
+	cycles    uint64 // clock cycles executed
+	maxCycles uint64 // cycles Run may execute, if not zero
+	hz        int    // clock speed Run is throttled to, if not zero
+
+	wait   bool   // halted until an interrupt is accepted
+	reason Reason // why the CPU stopped, if it has
+	fault  *Fault // the fault which stopped the CPU, if any
+
+	tracer func(*Trace)
+	trace  *Trace // trace of the current step, when tracing
+}
+
+// New returns a CPU ready to run p from its entry point. The text and data
+// sections are loaded into mem at their base addresses and the stack is
+// placed as the program's layout gives. If mem is nil a RAM block covering
+// the address space is used. An *AccessError is returned if the program does
+// not fit in mem.
+func New(p *vm.Program, mem Memory) (c *CPU, err error) {
+	if mem == nil {
+		mem = NewBlock(0)
+	}
+	defer recoverAccess(&err)
+
+	for _, t := range []vm.SecType{vm.TEXT, vm.DATA} {
+		base := p.Base(t)
+		for i, b := range p.SecTab[t] {
+			mem.Write(base+uint16(i), b)
+		}
+	}
+	c = &CPU{pc: p.Entry, fl: FlagZ, irq: new(Interrupts), mem: mem}
+	c.sp, c.ss = p.Stack()
+	c.sb = c.sp
+
+	// set return address on stack to invalid address
+	c.mem.Write(c.sp, 0xff)   // lsb
+	c.mem.Write(c.sp+1, 0xff) // msb
+	c.sp += 2
+	return c, nil
+}
+
+func (c *CPU) decode() {
+	switch vm.Opcode(c.ir & 0x3f) {
+	case vm.NOP:
+	case vm.CALL:
+	case vm.RET:
+		c.sp--
+		c.ar = c.sp
+		c.dr = c.mem.Fetch(c.ar)
+		c.sp--
+		c.ar = c.sp
+	case vm.POP:
+		c.sp--
+		c.ar = c.sp
+	case vm.PUSH:
+		c.dr = c.ac
+		c.ar = c.sp
+		c.sp++
+	case vm.MVR:
+		c.dr = c.ac
+	case vm.MVI:
+	case vm.MOV, vm.ADD, vm.DIV, vm.MUL, vm.SHL, vm.SHR, vm.SUB, vm.AND, vm.OR,
+		vm.ADC, vm.SBB, vm.CMP:
+		switch vm.Register(c.ir & 0xc0) {
+		case vm.REGB:
+			c.dr = c.b
+		case vm.REGC:
+			c.dr = c.c
+		}
+	case vm.INC:
+		c.dr = 1
+	case vm.LDA:
+	case vm.STA:
+		c.dr = c.ac
+	case vm.LDAX:
+		c.ar = uint16(c.b)<<8 | uint16(c.c)
+	case vm.STAX:
+		c.ar = uint16(c.b)<<8 | uint16(c.c)
+		c.dr = c.ac
+	}
+}
+
+// exec executes the decoded instruction, returning the kind of fault it
+// caused or zero
+func (c *CPU) exec() FaultKind {
+	op := vm.Opcode(c.ir & 0x3f)
+	if op.IsJump() {
+		if c.cond(op) {
+			c.pc = c.ar
+		}
+		return 0
+	}
+
+	switch op {
+	case vm.NOP:
+	case vm.CALL:
+		c.ar = c.sp
+		c.sp++
+		c.write(c.ar, uint8(c.pc))
+		c.ar = c.sp
+		c.sp++
+		c.write(c.ar, uint8(c.pc>>8))
+		c.pc = uint16(c.tr) << 8
+		c.pc |= uint16(c.dr)
+	case vm.RET:
+		c.pc = uint16(c.dr) << 8
+		c.dr = c.mem.Fetch(c.ar)
+		c.pc |= uint16(c.dr)
+	case vm.MOV:
+		c.ac = c.dr
+		c.fl.result(c.ac)
+	case vm.MVR:
+		switch vm.Register(c.ir & 0xc0) {
+		case vm.REGB:
+			c.b = c.dr
+		case vm.REGC:
+			c.c = c.dr
+		}
+	case vm.MVI:
+		c.ac = c.dr
+		c.fl.result(c.ac)
+	case vm.CLA:
+		c.ac = 0
+		c.fl.result(c.ac)
+	case vm.CLR:
+		c.ac = 0
+		c.fl.result(c.ac)
+	case vm.POP:
+		c.dr = c.mem.Fetch(c.ar)
+		c.ac = c.dr
+		c.fl.result(c.ac)
+	case vm.PUSH:
+		c.write(c.ar, c.dr)
+	case vm.ADD:
+		c.ac = c.add(c.dr, 0)
+	case vm.ADC:
+		c.ac = c.add(c.dr, c.carry())
+	case vm.INC:
+		// like the 8080, increment leaves carry alone for multi-byte counters
+		carry := c.fl.has(FlagC)
+		c.ac = c.add(c.dr, 0)
+		c.fl.set(FlagC, carry)
+	case vm.DIV:
+		if c.dr == 0 {
+			return DivideByZero
+		}
+		c.ac /= c.dr
+		c.fl.set(FlagC, false)
+		c.fl.set(FlagV, false)
+		c.fl.set(FlagH, false)
+		c.fl.result(c.ac)
+	case vm.MUL:
+		r := uint16(c.ac) * uint16(c.dr)
+		c.ac = byte(r)
+		c.fl.set(FlagC, r > 0xff)
+		c.fl.set(FlagV, r > 0xff)
+		c.fl.set(FlagH, false)
+		c.fl.result(c.ac)
+	case vm.SHL:
+		// carry holds the last bit shifted out
+		if c.dr > 0 {
+			c.fl.set(FlagC, c.dr <= 8 && c.ac>>(8-c.dr)&1 != 0)
+		}
+		c.ac <<= c.dr
+		c.fl.result(c.ac)
+	case vm.SHR:
+		if c.dr > 0 {
+			c.fl.set(FlagC, c.dr <= 8 && c.ac>>(c.dr-1)&1 != 0)
+		}
+		c.ac >>= c.dr
+		c.fl.result(c.ac)
+	case vm.SUB:
+		c.ac = c.sub(c.dr, 0)
+	case vm.SBB:
+		c.ac = c.sub(c.dr, c.carry())
+	case vm.CMP:
+		c.sub(c.dr, 0)
+	case vm.AND:
+		c.ac &= c.dr
+		c.logic()
+	case vm.OR:
+		c.ac |= c.dr
+		c.logic()
+	case vm.LDA, vm.LDAX:
+		c.dr = c.mem.Fetch(c.ar)
+		c.ac = c.dr
+		c.fl.result(c.ac)
+	case vm.STA, vm.STAX:
+		c.write(c.ar, c.dr)
+	case vm.EI:
+		// like the 8080, enabling takes effect after the next instruction
+		// so a handler can always return before another interrupt
+		c.eid = true
+	case vm.DI:
+		c.ie, c.eid = false, false
+	case vm.RETI:
+		c.sp--
+		c.ar = c.sp
+		c.fl = Flags(c.mem.Fetch(c.ar))
+		c.sp--
+		c.ar = c.sp
+		c.pc = uint16(c.mem.Fetch(c.ar)) << 8
+		c.sp--
+		c.ar = c.sp
+		c.pc |= uint16(c.mem.Fetch(c.ar))
+		c.eid = true
+	case vm.LIV:
+		c.iv = c.ar
+	case vm.HLT:
+		if c.ie || c.eid {
+			c.wait = true
+		} else {
+			c.reason = Halted
+		}
+	}
+	return 0
+}
+
+// stackUse returns the number of bytes op pushes onto the stack, or pops
+// from it if negative
+func stackUse(op vm.Opcode) int {
+	switch op {
+	case vm.PUSH:
+		return 1
+	case vm.CALL:
+		return 2
+	case vm.POP:
+		return -1
+	case vm.RET:
+		return -2
+	case vm.RETI:
+		return -3
+	}
+	return 0
+}
+
+// checkStack returns the kind of fault caused by pushing n bytes, or
+// popping -n bytes, or zero if the stack has room
+func (c *CPU) checkStack(n int) FaultKind {
+	switch {
+	case n > 0 && int(c.sp)+n > int(c.stackLimit()):
+		return StackOverflow
+	case n < 0 && int(c.sp)+n < int(c.sb):
+		return StackUnderflow
+	}
+	return 0
+}
+
+// stackLimit returns the address the stack may not grow to, which is the
+// end of the stack if the program sized it or else the lowest device
+// address when memory is a Bus
+func (c *CPU) stackLimit() uint16 {
+	if c.ss > 0 && int(c.sb)+int(c.ss) <= 0xffff {
+		return c.sb + c.ss
+	}
+	if b, ok := c.mem.(*Bus); ok {
+		return b.DeviceBase()
+	}
+	return 0xffff
+}
+
+// interrupt accepts the highest priority pending interrupt, if interrupts
+// are enabled. The return address and flags are pushed, further interrupts
+// are disabled and execution continues at the line's entry in the vector
+// table. Handlers must save any registers they use.
+func (c *CPU) interrupt() FaultKind {
+	if !c.ie || c.irq == nil {
+		return 0
+	}
+	line, ok := c.irq.accept()
+	if !ok {
+		return 0
+	}
+	if k := c.checkStack(3); k != 0 {
+		return k
+	}
+	c.ar = c.sp
+	c.sp++
+	c.write(c.ar, uint8(c.pc))
+	c.ar = c.sp
+	c.sp++
+	c.write(c.ar, uint8(c.pc>>8))
+	c.ar = c.sp
+	c.sp++
+	c.write(c.ar, byte(c.fl))
+	c.ie = false
+	c.wait = false
+	c.pc = c.iv + uint16(line)*vectorSize
+	c.cycles += interruptCycles
+	if c.trace != nil {
+		c.trace.IRQ = line
+	}
+	return 0
+}
+
+// add returns ac + v + carry, setting every flag from the result
+func (c *CPU) add(v, carry byte) byte {
+	r := uint16(c.ac) + uint16(v) + uint16(carry)
+	c.fl.set(FlagC, r > 0xff)
+	c.fl.set(FlagH, c.ac&0xf+v&0xf+carry > 0xf)
+	c.fl.set(FlagV, (c.ac^byte(r))&(v^byte(r))&0x80 != 0)
+	c.fl.result(byte(r))
+	return byte(r)
+}
+
+// sub returns ac - v - borrow, setting every flag from the result. The
+// carry flag is set when a borrow occurs.
+func (c *CPU) sub(v, borrow byte) byte {
+	r := int(c.ac) - int(v) - int(borrow)
+	c.fl.set(FlagC, r < 0)
+	c.fl.set(FlagH, int(c.ac&0xf)-int(v&0xf)-int(borrow) < 0)
+	c.fl.set(FlagV, (c.ac^v)&(c.ac^byte(r))&0x80 != 0)
+	c.fl.result(byte(r))
+	return byte(r)
+}
+
+// logic sets the flags after a logical operation, which never carries or
+// overflows
+func (c *CPU) logic() {
+	c.fl.set(FlagC, false)
+	c.fl.set(FlagV, false)
+	c.fl.set(FlagH, false)
+	c.fl.result(c.ac)
+}
+
+func (c *CPU) carry() byte {
+	if c.fl.has(FlagC) {
+		return 1
+	}
+	return 0
+}
+
+// cond reports whether the condition of jump instruction op holds. Signed
+// comparisons follow a cmp or sub: less than is sign differing from
+// overflow. Unsigned comparisons use carry as borrow.
+func (c *CPU) cond(op vm.Opcode) bool {
+	z, cy := c.fl.has(FlagZ), c.fl.has(FlagC)
+	lt := c.fl.has(FlagS) != c.fl.has(FlagV)
+	switch op {
+	case vm.JMP:
+		return true
+	case vm.JPZ:
+		return z
+	case vm.JNZ:
+		return !z
+	case vm.JC:
+		return cy
+	case vm.JNC:
+		return !cy
+	case vm.JS:
+		return c.fl.has(FlagS)
+	case vm.JNS:
+		return !c.fl.has(FlagS)
+	case vm.JV:
+		return c.fl.has(FlagV)
+	case vm.JNV:
+		return !c.fl.has(FlagV)
+	case vm.JGT:
+		return !z && !lt
+	case vm.JGE:
+		return !lt
+	case vm.JLT:
+		return lt
+	case vm.JLE:
+		return z || lt
+	case vm.JA:
+		return !cy && !z
+	case vm.JBE:
+		return cy || z
+	}
+	return false
+}
+
+func (c *CPU) fetch() {
+	// cycle 1
+	c.ar = c.pc              // set address register to the program counter
+	c.pc++                   // advance the program counter
+	c.dr = c.mem.Fetch(c.ar) // fetch instruction into data register
+	c.ir = c.dr              // set the instruction register to the data register
+
+	switch op := vm.Opcode(c.ir); {
+	case op == vm.CALL: // cycle 2 and 3
+		// load address to jump to
+		c.dr = c.mem.Fetch(c.pc)
+		c.pc++
+		c.tr = c.dr
+		c.dr = c.mem.Fetch(c.pc)
+		c.pc++
+	case op.IsJump(), op == vm.LDA, op == vm.STA, op == vm.LIV: // cycle 2 and 3
+		c.dr = c.mem.Fetch(c.pc)
+		c.ar = uint16(c.dr) << 8
+		c.pc++
+		c.dr = c.mem.Fetch(c.pc)
+		c.ar |= uint16(c.dr)
+		c.pc++
+	case op == vm.MVI: // cycle 2
+		c.dr = c.mem.Fetch(c.pc)
+		c.pc++
+	}
+}
+
+// Step executes a single instruction then accepts any interrupt raised.
+// While halted waiting for an interrupt no instruction is executed but
+// devices continue to tick. A *Fault is returned if the instruction faults,
+// after which the CPU is stopped.
+func (c *CPU) Step() (err error) {
+	if c.Stopped() {
+		if c.fault != nil {
+			return c.fault
+		}
+		return nil
+	}
+	pc := c.pc
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*AccessError)
+			if !ok {
+				panic(r)
+			}
+			f := c.stop(BadAddress, pc)
+			f.Addr = e.Addr
+			err = f
+		}
+	}()
+
+	c.trace = nil
+	if c.tracer != nil {
+		c.trace = &Trace{PC: pc, IRQ: -1}
+	}
+	n := waitCycles
+	if !c.wait {
+		enable := c.eid
+		c.fetch()
+		if c.trace != nil {
+			c.trace.Inst = c.inst()
+		}
+		// the same encodings are illegal as when disassembling
+		op := vm.Opcode(c.ir & 0x3f)
+		if !op.Valid() || !op.ValidRegister(vm.Register(c.ir&0xc0)) {
+			return c.stop(IllegalInstruction, pc)
+		}
+		if k := c.checkStack(stackUse(op)); k != 0 {
+			return c.stop(k, pc)
+		}
+		c.decode()
+		if k := c.exec(); k != 0 {
+			return c.stop(k, pc)
+		}
+		n = op.Cycles()
+		if enable && c.eid {
+			c.ie, c.eid = true, false
+		}
+		if c.pc == 0xffff {
+			c.reason = Returned
+		}
+	}
+	c.cycles += uint64(n)
+	if t, ok := c.mem.(Ticker); ok {
+		t.Tick(n)
+	}
+	if k := c.interrupt(); k != 0 {
+		return c.stop(k, c.pc)
+	}
+	if c.trace != nil && (c.trace.Inst != nil || c.trace.IRQ >= 0) {
+		c.trace.Regs = c.Regs()
+		c.trace.Cycles = c.cycles
+		c.tracer(c.trace)
+	}
+	return nil
+}
+
+// stop stops the CPU with a fault of kind k caused by the instruction at
+// pc. The program counter is left pointing at the instruction.
+func (c *CPU) stop(k FaultKind, pc uint16) *Fault {
+	c.pc = pc
+	c.reason = Faulted
+	c.fault = &Fault{Kind: k, PC: pc, IR: c.ir, Regs: c.Regs()}
+	return c.fault
+}
+
+// Regs returns a snapshot of the registers
+func (c *CPU) Regs() Regs {
+	return Regs{PC: c.pc, SP: c.sp, AC: c.ac, B: c.b, C: c.c, Flags: c.fl,
+		IE: c.ie, Vectors: c.iv, StackBase: c.sb}
+}
+
+// Fault returns the fault which stopped the CPU, or nil
+func (c *CPU) Fault() *Fault {
+	return c.fault
+}
+
+// Stopped reports whether the CPU has stopped running
+func (c *CPU) Stopped() bool {
+	return c.reason != Running
+}
+
+// Reason returns why the CPU stopped, or Running if it has not
+func (c *CPU) Reason() Reason {
+	return c.reason
+}
+
+// ExitCode returns the program's exit status, which is the value of the
+// accumulator when it halted or returned from its entry point
+func (c *CPU) ExitCode() int {
+	return int(c.ac)
+}
+
+var (
+	// ErrBudget is returned by Run when the instruction budget is
+	// exhausted
+	ErrBudget = errors.New("instruction budget exhausted")
+
+	// ErrCycleLimit is returned by Run when the cycle limit is reached
+	ErrCycleLimit = errors.New("cycle limit reached")
+)
+
+// Run executes instructions until the CPU stops, ctx is cancelled or, if
+// budget is positive, budget steps have been taken. It returns a *Fault if
+// the CPU stopped because of one, the context's error if it was cancelled,
+// ErrBudget if the budget was exhausted and ErrCycleLimit if the cycle
+// limit was reached. In all but the first case the CPU is still running and
+// Run may be called again to continue.
+func (c *CPU) Run(ctx context.Context, budget int) error {
+	start, t0 := c.cycles, time.Now()
+	for n := 0; !c.Stopped(); n++ {
+		if budget > 0 && n == budget {
+			return ErrBudget
+		}
+		if c.maxCycles > 0 && c.cycles >= c.maxCycles {
+			return ErrCycleLimit
+		}
+		// checking the context and clock is relatively costly so only do
+		// so periodically
+		if n%1024 == 0 {
+			if err := c.throttle(ctx, c.cycles-start, t0); err != nil {
+				return err
+			}
+		}
+		if err := c.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// throttle waits until the time elapsed since t0 matches the time taken to
+// execute cycles at the clock speed, returning early if ctx is cancelled
+func (c *CPU) throttle(ctx context.Context, cycles uint64, t0 time.Time) error {
+	if err := ctx.Err(); err != nil || c.hz <= 0 {
+		return err
+	}
+	hz := uint64(c.hz)
+	elapsed := time.Duration(cycles/hz)*time.Second +
+		time.Duration(cycles%hz*uint64(time.Second)/hz)
+	due := t0.Add(elapsed)
+	d := time.Until(due)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Cycles returns the number of clock cycles executed
+func (c *CPU) Cycles() uint64 {
+	return c.cycles
+}
+
+// SetCycleLimit limits the number of cycles Run executes before returning
+// ErrCycleLimit. Zero removes the limit.
+func (c *CPU) SetCycleLimit(n uint64) {
+	c.maxCycles = n
+}
+
+// SetClock throttles Run to execute hz cycles per second. Zero runs as fast
+// as possible.
+func (c *CPU) SetClock(hz int) {
+	c.hz = hz
+}
+
+func (c *CPU) PC() uint16        { return c.pc }
+func (c *CPU) SP() uint16        { return c.sp }
+func (c *CPU) A() byte           { return c.ac }
+func (c *CPU) B() byte           { return c.b }
+func (c *CPU) C() byte           { return c.c }
+func (c *CPU) Flags() Flags      { return c.fl }
+func (c *CPU) SetPC(v uint16)    { c.pc = v }
+func (c *CPU) SetSP(v uint16)    { c.sp = v }
+func (c *CPU) SetA(v byte)       { c.ac = v }
+func (c *CPU) SetB(v byte)       { c.b = v }
+func (c *CPU) SetC(v byte)       { c.c = v }
+func (c *CPU) SetFlags(fl Flags) { c.fl = fl }
+
+// Interrupts returns the interrupt controller devices raise interrupts on
+func (c *CPU) Interrupts() *Interrupts {
+	return c.irq
+}
+
+// Memory returns the memory the CPU is connected to
+func (c *CPU) Memory() Memory {
+	return c.mem
+}
+
+// Read returns the byte at addr, or an *AccessError if addr is outside of
+// memory
+func (c *CPU) Read(addr uint16) (b byte, err error) {
+	defer recoverAccess(&err)
+	return c.mem.Fetch(addr), nil
+}
+
+// Write writes b to addr, returning an *AccessError if addr is outside of
+// memory
+func (c *CPU) Write(addr uint16, b byte) (err error) {
+	defer recoverAccess(&err)
+	c.mem.Write(addr, b)
+	return nil
+}
+
+// recoverAccess recovers an *AccessError panic into *err. It must be
+// deferred directly.
+func recoverAccess(err *error) {
+	if r := recover(); r != nil {
+		e, ok := r.(*AccessError)
+		if !ok {
+			panic(r)
+		}
+		*err = e
+	}
+}
@@ -0,0 +1,423 @@
+package cpu_test
+
+import (
+	"bytes"
+	"context"
+	"go/token"
+	"strings"
+	"testing"
+
+	"github.com/rthornton128/vm/cpu"
+	vm "github.com/rthornton128/vm/lib"
+)
+
+// load assembles and links src into a program and returns a CPU ready to
+// run it
+func load(t *testing.T, src string) *cpu.CPU {
+	return loadMem(t, src, nil)
+}
+
+// loadMem is like load but connects the CPU to mem
+func loadMem(t *testing.T, src string, mem cpu.Memory) *cpu.CPU {
+	fset := token.NewFileSet()
+	f := fset.AddFile("test.a", -1, len(src))
+	b := new(bytes.Buffer)
+	if err := vm.NewEncoder(f, b).Encode(strings.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	ob, err := vm.ScanObject(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := vm.NewObject()
+	if err := o.Merge(ob); err != nil {
+		t.Fatal(err)
+	}
+	c, err := cpu.New(vm.NewProgram(o), mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRun(t *testing.T) {
+	c := load(t, `.text
+main:
+mvi 3
+mvr %b
+mvi 4
+add %b
+ret
+`)
+	if err := c.Run(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if c.Reason() != cpu.Returned {
+		t.Fatal("expected returned, got", c.Reason())
+	}
+	if c.ExitCode() != 7 {
+		t.Fatal("expected exit code 7, got", c.ExitCode())
+	}
+}
+
+func TestRunHalt(t *testing.T) {
+	c := load(t, `.text
+main:
+mvi 1
+hlt
+mvi 2
+`)
+	if err := c.Run(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if c.Reason() != cpu.Halted || c.ExitCode() != 1 {
+		t.Fatal("expected halted with 1, got", c.Reason(), c.ExitCode())
+	}
+}
+
+func TestRunLimits(t *testing.T) {
+	c := load(t, `.text
+main:
+jmp $main
+`)
+	if err := c.Run(context.Background(), 10); err != cpu.ErrBudget {
+		t.Fatal("expected budget exhausted, got", err)
+	}
+	if c.Stopped() {
+		t.Fatal("expected CPU to still be running")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Run(ctx, 0); err != context.Canceled {
+		t.Fatal("expected cancellation, got", err)
+	}
+}
+
+func TestFault(t *testing.T) {
+	c := load(t, `.text
+main:
+mvi 5
+div %b
+`)
+	err := c.Run(context.Background(), 0)
+	f, ok := err.(*cpu.Fault)
+	if !ok {
+		t.Fatal("expected fault, got", err)
+	}
+	if f.Kind != cpu.DivideByZero || f.PC != 2 {
+		t.Fatal("expected divide by zero at 0002, got", f)
+	}
+	if f.Regs.AC != 5 || c.PC() != 2 {
+		t.Fatal("expected registers at fault, got", f.Regs)
+	}
+	if err := c.Step(); err != f {
+		t.Fatal("expected step to return the fault, got", err)
+	}
+}
+
+func TestRegisters(t *testing.T) {
+	c := load(t, `.text
+main:
+mov %b
+mvr %c
+ret
+`)
+	c.SetB(0x42)
+	for i := 0; i < 2; i++ {
+		if err := c.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.A() != 0x42 || c.C() != 0x42 {
+		t.Fatal("expected a and c to be 0x42, got", c.A(), c.C())
+	}
+	if c.PC() != 2 {
+		t.Fatal("expected pc 2, got", c.PC())
+	}
+}
+
+func TestMemory(t *testing.T) {
+	c := load(t, `.text
+main:
+lda $x
+ret
+.data
+x: .byte 9
+`)
+	if b, err := c.Read(4); err != nil || b != 9 {
+		t.Fatal("expected 9 at 0004, got", b, err)
+	}
+	if err := c.Write(4, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Run(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if c.ExitCode() != 10 {
+		t.Fatal("expected 10, got", c.ExitCode())
+	}
+
+	small := cpu.NewBlock(1)
+	p := &vm.Program{SecTab: make(vm.SectionTable, 2)}
+	if _, err := cpu.New(p, small); err == nil {
+		t.Fatal("expected program not to fit")
+	}
+}
+
+func TestCycles(t *testing.T) {
+	for op := vm.Opcode(0); op < 0x40; op++ {
+		if op.Valid() && op.Cycles() == 0 {
+			t.Fatal("no cycle cost for", op)
+		}
+	}
+
+	c := load(t, `.text
+main:
+mvi 1
+ret
+`)
+	if err := c.Run(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := uint64(vm.MVI.Cycles() + vm.RET.Cycles()); c.Cycles() != n {
+		t.Fatal("expected", n, "cycles, got", c.Cycles())
+	}
+
+	c = load(t, `.text
+main:
+jmp $main
+`)
+	c.SetCycleLimit(100)
+	if err := c.Run(context.Background(), 0); err != cpu.ErrCycleLimit {
+		t.Fatal("expected cycle limit, got", err)
+	}
+	if c.Cycles() < 100 || c.Cycles() >= 100+uint64(vm.JMP.Cycles()) {
+		t.Fatal("expected to stop at 100 cycles, got", c.Cycles())
+	}
+}
+
+func TestStackSize(t *testing.T) {
+	p := &vm.Program{SecTab: make(vm.SectionTable, 2)}
+	p.SecTab[vm.TEXT] = []byte{byte(vm.CALL), 0x0, 0x0}
+	p.Layout.SetStack(0x100, 8)
+	c, err := cpu.New(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Run(context.Background(), 0)
+	if f, ok := err.(*cpu.Fault); !ok || f.Kind != cpu.StackOverflow {
+		t.Fatal("expected stack overflow, got", err)
+	}
+	if c.SP() != 0x108 {
+		t.Fatal("expected the stack to fill to 0108, got", c.SP())
+	}
+}
+
+func TestIllegalInstruction(t *testing.T) {
+	for _, ir := range []byte{
+		byte(vm.JMP) | byte(vm.REGC),
+		byte(vm.ADD) | 0x40,
+		byte(vm.MVI) | byte(vm.REGC),
+		0x3f,
+	} {
+		p := &vm.Program{SecTab: make(vm.SectionTable, 2)}
+		p.SecTab[vm.TEXT] = []byte{byte(vm.NOP), ir, 0x0, 0x1}
+		c, err := cpu.New(p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Run(context.Background(), 10)
+		f, ok := err.(*cpu.Fault)
+		if !ok || f.Kind != cpu.IllegalInstruction || f.PC != 1 || f.IR != ir {
+			t.Fatalf("expected illegal instruction %#02x at 0001, got %v", ir, err)
+		}
+	}
+}
+
+// run returns a CPU which has executed the single instruction in text with
+// the accumulator, b and flags set
+func run(t *testing.T, text []byte, a, b byte, fl cpu.Flags) *cpu.CPU {
+	p := &vm.Program{SecTab: make(vm.SectionTable, 2)}
+	p.SecTab[vm.TEXT] = text
+	c, err := cpu.New(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetA(a)
+	c.SetB(b)
+	c.SetFlags(fl)
+	if err := c.Step(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestFlags(t *testing.T) {
+	const (
+		z, cy, s, v, h = cpu.FlagZ, cpu.FlagC, cpu.FlagS, cpu.FlagV, cpu.FlagH
+	)
+	for _, test := range []struct {
+		op     vm.Opcode
+		a, b   byte
+		in     cpu.Flags
+		result byte
+		flags  cpu.Flags
+	}{
+		{vm.ADD, 0x0f, 0x01, 0, 0x10, h},
+		{vm.ADD, 0x7f, 0x01, 0, 0x80, s | v | h},
+		{vm.ADD, 0xff, 0x01, 0, 0x00, z | cy | h},
+		{vm.ADD, 0x80, 0x80, 0, 0x00, z | cy | v},
+		{vm.ADD, 0x01, 0x01, cy, 0x02, 0},
+		{vm.ADC, 0x01, 0x01, cy, 0x03, 0},
+		{vm.ADC, 0xff, 0x00, cy, 0x00, z | cy | h},
+		{vm.ADC, 0x7f, 0x00, cy, 0x80, s | v | h},
+		{vm.SUB, 0x05, 0x03, 0, 0x02, 0},
+		{vm.SUB, 0x03, 0x05, 0, 0xfe, cy | s | h},
+		{vm.SUB, 0x80, 0x01, 0, 0x7f, v | h},
+		{vm.SUB, 0x10, 0x10, cy, 0x00, z},
+		{vm.SBB, 0x05, 0x03, cy, 0x01, 0},
+		{vm.SBB, 0x00, 0x00, cy, 0xff, cy | s | h},
+		{vm.SBB, 0x80, 0x00, cy, 0x7f, v | h},
+		{vm.CMP, 0x05, 0x05, 0, 0x05, z},
+		{vm.CMP, 0x03, 0x05, 0, 0x03, cy | s | h},
+		{vm.CMP, 0x80, 0x01, 0, 0x80, v | h},
+		{vm.INC, 0xff, 0x00, cy, 0x00, z | cy | h},
+		{vm.INC, 0x7f, 0x00, 0, 0x80, s | v | h},
+		{vm.SHL, 0x81, 0x01, 0, 0x02, cy},
+		{vm.SHR, 0x01, 0x01, 0, 0x00, z | cy},
+		{vm.AND, 0xf0, 0x0f, cy | v | h, 0x00, z},
+	} {
+		c := run(t, []byte{byte(test.op)}, test.a, test.b, test.in)
+		if c.A() != test.result || c.Flags() != test.flags {
+			t.Fatalf("%s %#02x, %#02x: expected %#02x %s, got %#02x %s", test.op,
+				test.a, test.b, test.result, test.flags, c.A(), c.Flags())
+		}
+	}
+}
+
+func TestConditionalJumps(t *testing.T) {
+	const (
+		z, cy, s, v = cpu.FlagZ, cpu.FlagC, cpu.FlagS, cpu.FlagV
+	)
+	for _, test := range []struct {
+		op    vm.Opcode
+		flags cpu.Flags
+		taken bool
+	}{
+		{vm.JMP, 0, true},
+		{vm.JPZ, z, true}, {vm.JPZ, 0, false},
+		{vm.JNZ, 0, true}, {vm.JNZ, z, false},
+		{vm.JC, cy, true}, {vm.JC, 0, false},
+		{vm.JNC, 0, true}, {vm.JNC, cy, false},
+		{vm.JS, s, true}, {vm.JS, 0, false},
+		{vm.JNS, 0, true}, {vm.JNS, s, false},
+		{vm.JV, v, true}, {vm.JV, 0, false},
+		{vm.JNV, 0, true}, {vm.JNV, v, false},
+		{vm.JGT, 0, true}, {vm.JGT, s | v, true}, {vm.JGT, z, false},
+		{vm.JGT, s, false}, {vm.JGT, v, false},
+		{vm.JGE, 0, true}, {vm.JGE, s | v, true}, {vm.JGE, z, true},
+		{vm.JGE, s, false}, {vm.JGE, v, false},
+		{vm.JLT, s, true}, {vm.JLT, v, true}, {vm.JLT, 0, false},
+		{vm.JLT, s | v, false},
+		{vm.JLE, z, true}, {vm.JLE, s, true}, {vm.JLE, v, true},
+		{vm.JLE, 0, false}, {vm.JLE, s | v, false},
+		{vm.JA, 0, true}, {vm.JA, cy, false}, {vm.JA, z, false},
+		{vm.JBE, cy, true}, {vm.JBE, z, true}, {vm.JBE, 0, false},
+	} {
+		c := run(t, []byte{byte(test.op), 0x0, 0x10}, 0, 0, test.flags)
+		if taken := c.PC() == 0x10; taken != test.taken {
+			t.Fatalf("%s with %s: expected taken %v, got pc %04x", test.op,
+				test.flags, test.taken, c.PC())
+		}
+	}
+}
+
+func TestInterrupts(t *testing.T) {
+	bus := cpu.NewBus(cpu.NewBlock(0))
+	timer := new(cpu.Timer)
+	if err := bus.Map("timer", 0xff04, timer); err != nil {
+		t.Fatal(err)
+	}
+	c := loadMem(t, `.text
+main:
+liv $vectors
+mvi 15
+sta 0xff06
+mvi 1
+sta 0xff07
+sta 0xff04
+ei
+hlt
+hlt
+ret
+vectors:
+jmp $vectors
+jmp $tick
+tick:
+inc
+reti
+`, bus)
+	timer.Connect(func() { c.Interrupts().Raise(1) })
+	const (
+		ei, hlt1, hlt2, ret, vector = 0x10, 0x11, 0x12, 0x13, 0x17
+	)
+	step := func() {
+		if err := c.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for c.PC() != ei {
+		step()
+	}
+	sp := c.SP()
+
+	// an interrupt raised before ei is only taken after the next instruction
+	c.Interrupts().Raise(1)
+	step()
+	if c.PC() != hlt1 || c.Regs().IE || c.Interrupts().Pending() != 0x2 {
+		t.Fatal("expected interrupt to wait after ei, got", c.Regs())
+	}
+	fl := c.Flags()
+	step()
+	if c.PC() != vector || c.Regs().IE || c.SP() != sp+3 {
+		t.Fatal("expected interrupt to be taken after hlt, got", c.Regs())
+	}
+	for i, b := range []byte{hlt2, 0x0, byte(fl)} {
+		if m, _ := c.Read(sp + uint16(i)); m != b {
+			t.Fatalf("expected %#02x pushed at %04x, got %#02x", b, sp+uint16(i), m)
+		}
+	}
+
+	// reti pops the flags and return address, enabling interrupts after
+	// the next instruction
+	step()
+	step()
+	c.SetFlags(0)
+	step()
+	if c.PC() != hlt2 || c.SP() != sp || c.Flags() != fl || c.Regs().IE {
+		t.Fatal("expected reti to return to", hlt2, "got", c.Regs())
+	}
+
+	// hlt waits, without executing instructions, for the timer
+	step()
+	if c.PC() != ret || !c.Regs().IE {
+		t.Fatal("expected to wait at hlt with interrupts enabled, got", c.Regs())
+	}
+	n := 0
+	for ; c.PC() == ret; n++ {
+		step()
+		if n > 100 {
+			t.Fatal("expected the timer to interrupt")
+		}
+	}
+	if c.PC() != vector || n < 2 {
+		t.Fatal("expected the timer to interrupt after waiting, got", c.Regs(), n)
+	}
+	if err := c.Run(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if c.Reason() != cpu.Returned || c.ExitCode() != 3 {
+		t.Fatal("expected to return 3, got", c.Reason(), c.ExitCode())
+	}
+}
@@ -0,0 +1,247 @@
+package cpu
+
+import (
+	"bufio"
+	"io"
+	"math/rand"
+	"time"
+)
+
+// Console is a character device. Writing to offset 0 outputs a character
+// and reading from it returns the next character of input, waiting for one
+// if necessary, or zero once input is exhausted. Offset 1 is a status
+// register whose bit 0 is set once input is exhausted and bit 1 while a
+// character is ready to be read without waiting. Setting bit 0 of the
+// control register at offset 2 raises an interrupt as each character
+// becomes ready.
+type Console struct {
+	r     io.Reader
+	in    chan byte // closed at the end of input, nil until reading starts
+	next  byte      // character received but not yet read
+	ready bool
+	eof   bool
+	out   io.Writer
+	ctl   byte
+	raise func()
+}
+
+const (
+	conData    = 0
+	conStatus  = 1
+	conControl = 2
+
+	conEOF   = 0x1
+	conReady = 0x2
+
+	conIntr = 0x1
+)
+
+// NewConsole returns a console reading from in and writing to out. Input is
+// read in the background so the console can report when it is ready, but
+// only once the program first reads the console or enables its interrupt.
+func NewConsole(in io.Reader, out io.Writer) *Console {
+	return &Console{r: in, out: out}
+}
+
+// start starts reading input, if it hasn't been started already
+func (c *Console) start() {
+	if c.in != nil {
+		return
+	}
+	c.in = make(chan byte, 64)
+	go func() {
+		r := bufio.NewReader(c.r)
+		for {
+			b, err := r.ReadByte()
+			if err != nil {
+				close(c.in)
+				return
+			}
+			c.in <- b
+		}
+	}()
+}
+
+func (c *Console) Size() uint16 {
+	return 3
+}
+
+// poll receives the next character of input, if one has not been received
+// already, and reports whether one is ready. It only waits for input if
+// wait is true.
+func (c *Console) poll(wait bool) bool {
+	if c.ready || c.eof {
+		return c.ready
+	}
+	c.start()
+	var b byte
+	ok := true
+	if wait {
+		b, ok = <-c.in
+	} else {
+		select {
+		case b, ok = <-c.in:
+		default:
+			return false
+		}
+	}
+	if !ok {
+		c.eof = true
+		return false
+	}
+	c.next, c.ready = b, true
+	return true
+}
+
+func (c *Console) Fetch(off uint16) byte {
+	switch off {
+	case conData:
+		if !c.poll(true) {
+			return 0
+		}
+		c.ready = false
+		return c.next
+	case conStatus:
+		var st byte
+		if c.poll(false) {
+			st |= conReady
+		}
+		if c.eof {
+			st |= conEOF
+		}
+		return st
+	case conControl:
+		return c.ctl
+	}
+	return 0
+}
+
+func (c *Console) Write(off uint16, data byte) {
+	switch off {
+	case conData:
+		c.out.Write([]byte{data})
+	case conControl:
+		c.ctl = data
+		if c.ctl&conIntr != 0 {
+			c.start()
+		}
+		// a character may have arrived before interrupts were enabled
+		if c.ctl&conIntr != 0 && c.ready && c.raise != nil {
+			c.raise()
+		}
+	}
+}
+
+func (c *Console) Connect(raise func()) {
+	c.raise = raise
+}
+
+// Tick raises an interrupt when a character becomes ready
+func (c *Console) Tick(cycles int) {
+	if c.ctl&conIntr == 0 || c.raise == nil || c.ready {
+		return
+	}
+	if c.poll(false) {
+		c.raise()
+	}
+}
+
+// Timer counts clock cycles. Offsets 0 and 1 hold the 16 bit count, most
+// significant byte first. Reading the high byte latches the low byte so the
+// count reads consistently. Offset 2 is a divider, the count is incremented
+// once every (divider+1)*16 cycles. Writing to either count byte
+// resets the count to zero. Setting bit 0 of the control register at
+// offset 3 raises an interrupt each time the count is incremented.
+type Timer struct {
+	count uint16
+	latch byte
+	div   byte
+	ticks uint32
+	ctl   byte
+	raise func()
+}
+
+const (
+	timerHigh    = 0
+	timerLow     = 1
+	timerDiv     = 2
+	timerControl = 3
+
+	timerIntr = 0x1
+
+	timerPrescale = 16 // cycles per tick of the divider
+)
+
+func (t *Timer) Size() uint16 {
+	return 4
+}
+
+func (t *Timer) Fetch(off uint16) byte {
+	switch off {
+	case timerHigh:
+		t.latch = byte(t.count)
+		return byte(t.count >> 8)
+	case timerLow:
+		return t.latch
+	case timerDiv:
+		return t.div
+	case timerControl:
+		return t.ctl
+	}
+	return 0
+}
+
+func (t *Timer) Write(off uint16, data byte) {
+	switch off {
+	case timerHigh, timerLow:
+		t.count, t.ticks = 0, 0
+	case timerDiv:
+		t.div, t.ticks = data, 0
+	case timerControl:
+		t.ctl = data
+	}
+}
+
+func (t *Timer) Connect(raise func()) {
+	t.raise = raise
+}
+
+func (t *Timer) Tick(cycles int) {
+	t.ticks += uint32(cycles)
+	period := (uint32(t.div) + 1) * timerPrescale
+	for t.ticks >= period {
+		t.ticks -= period
+		t.count++
+		if t.ctl&timerIntr != 0 && t.raise != nil {
+			t.raise()
+		}
+	}
+}
+
+// Random is a pseudo-random number generator. Reading offset 0 returns a
+// random byte and writing to it reseeds the generator with the byte
+// written.
+type Random struct {
+	r *rand.Rand
+}
+
+// NewRandom returns a generator seeded with seed, or with the time if seed
+// is zero
+func NewRandom(seed int64) *Random {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Random{r: rand.New(rand.NewSource(seed))}
+}
+
+func (r *Random) Size() uint16 {
+	return 1
+}
+
+func (r *Random) Fetch(off uint16) byte {
+	return byte(r.r.Intn(256))
+}
+
+func (r *Random) Write(off uint16, data byte) {
+	r.r.Seed(int64(data))
+}
@@ -0,0 +1,126 @@
+package cpu
+
+import (
+	"fmt"
+	"io"
+
+	vm "github.com/rthornton128/vm/lib"
+)
+
+// FaultKind classifies the cause of a fault
+type FaultKind int
+
+const (
+	BadAddress FaultKind = iota + 1
+	DivideByZero
+	IllegalInstruction
+	StackOverflow
+	StackUnderflow
+)
+
+var faultKinds = []string{
+	BadAddress:         "bad address",
+	DivideByZero:       "divide by zero",
+	IllegalInstruction: "illegal instruction",
+	StackOverflow:      "stack overflow",
+	StackUnderflow:     "stack underflow",
+}
+
+func (k FaultKind) String() string {
+	return faultKinds[k]
+}
+
+// Regs is a snapshot of the programmer visible registers
+type Regs struct {
+	PC, SP    uint16
+	AC, B, C  byte
+	Flags     Flags
+	IE        bool
+	Vectors   uint16
+	StackBase uint16
+}
+
+// Fault is an error which stops the CPU. PC is the address of the faulting
+// instruction and IR its opcode, while Regs holds the registers as they
+// were when the fault occurred.
+type Fault struct {
+	Kind FaultKind
+	PC   uint16
+	IR   byte
+	Addr uint16 // address accessed, for BadAddress
+	Regs Regs
+}
+
+func (f *Fault) Error() string {
+	if f.Kind == BadAddress {
+		return fmt.Sprintf("%s %04x at %04x", f.Kind, f.Addr, f.PC)
+	}
+	return fmt.Sprintf("%s at %04x", f.Kind, f.PC)
+}
+
+// AccessError is the panic value of a memory access outside the memory
+// available. The CPU recovers it and stops with a BadAddress fault.
+type AccessError struct {
+	Addr uint16
+}
+
+func (e *AccessError) Error() string {
+	return fmt.Sprintf("bad address %04x", e.Addr)
+}
+
+// Report writes a description of f to w naming addresses with syms and
+// source lines with lines, either of which may be empty. The instruction is
+// decoded from mem.
+func (f *Fault) Report(w io.Writer, syms *vm.AddressMap, lines *vm.LineTable, mem Memory) {
+	r := f.Regs
+	fmt.Fprintf(w, "fault: %s at %04x <%s>\n", f.Kind, f.PC, syms.Name(f.PC))
+	if pos := lines.Position(f.PC); pos != "" {
+		fmt.Fprintf(w, "  source      %s\n", pos)
+	}
+	if f.Kind == BadAddress {
+		fmt.Fprintf(w, "  address     %04x <%s>\n", f.Addr, syms.Name(f.Addr))
+	}
+	fmt.Fprintf(w, "  instruction %s\n", DecodeAt(mem, f.PC, syms))
+	fmt.Fprintf(w, "  a  %02x  b  %02x  c  %02x  flags %s\n", r.AC, r.B, r.C, r.Flags)
+	fmt.Fprintf(w, "  pc %04x <%s>  sp %04x\n", r.PC, syms.Name(r.PC), r.SP)
+
+	if r.SP <= r.StackBase {
+		return
+	}
+	fmt.Fprint(w, "  stack")
+	for addr := r.StackBase; addr < r.SP && addr-r.StackBase < 16; addr++ {
+		fmt.Fprintf(w, " %02x", safeFetch(mem, addr))
+	}
+	if r.SP-r.StackBase > 16 {
+		fmt.Fprint(w, " ...")
+	}
+	fmt.Fprintln(w)
+}
+
+// DecodeAt decodes the instruction in mem at addr, naming its operand with
+// syms. Bytes outside of memory are read as zero.
+func DecodeAt(mem Memory, addr uint16, syms *vm.AddressMap) vm.Inst {
+	b := []byte{safeFetch(mem, addr)}
+	for n := vm.Opcode(b[0] & 0x3f).Operands(); n > 0; n-- {
+		b = append(b, safeFetch(mem, addr+uint16(len(b))))
+	}
+	i, _ := vm.Decode(b, addr)
+	if i.Op.Operands() == 2 && !i.Illegal {
+		if _, _, ok := syms.Lookup(i.Operand); ok {
+			i.Symbol = syms.Name(i.Operand)
+		}
+	}
+	return i
+}
+
+// safeFetch reads addr from mem, returning zero if it is out of bounds
+func safeFetch(mem Memory, addr uint16) (b byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(*AccessError); !ok {
+				panic(r)
+			}
+		}
+	}()
+	return mem.Fetch(addr)
+}
@@ -0,0 +1,55 @@
+package cpu
+
+// Flags is the status register. Each bit records a property of the last
+// arithmetic, logical or load operation on the accumulator.
+type Flags byte
+
+const (
+	FlagZ Flags = 1 << iota // zero: result was zero
+	FlagC                   // carry: unsigned overflow or borrow
+	FlagS                   // sign: most significant bit of the result
+	FlagV                   // overflow: signed overflow
+	FlagH                   // half-carry: carry or borrow out of bit 3
+)
+
+var flagNames = []struct {
+	f Flags
+	n byte
+}{
+	{FlagZ, 'z'},
+	{FlagC, 'c'},
+	{FlagS, 's'},
+	{FlagV, 'v'},
+	{FlagH, 'h'},
+}
+
+// String returns the flags in the order zcsvh with cleared flags shown as
+// a dash
+func (f Flags) String() string {
+	b := make([]byte, len(flagNames))
+	for i, fn := range flagNames {
+		b[i] = '-'
+		if f&fn.f != 0 {
+			b[i] = fn.n
+		}
+	}
+	return string(b)
+}
+
+func (f *Flags) set(flag Flags, on bool) {
+	if on {
+		*f |= flag
+	} else {
+		*f &^= flag
+	}
+}
+
+func (f Flags) has(flag Flags) bool {
+	return f&flag != 0
+}
+
+// result sets the zero and sign flags from v
+func (f *Flags) result(v byte) {
+	f.set(FlagZ, v == 0)
+	f.set(FlagS, v&0x80 != 0)
+}
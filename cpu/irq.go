@@ -0,0 +1,36 @@
+package cpu
+
+// NumIRQ is the number of interrupt lines
+const NumIRQ = 8
+
+// vectorSize is the size of each entry in the vector table, which holds a
+// jmp instruction per interrupt line
+const vectorSize = 3
+
+// Interrupts is an interrupt controller. Devices raise a line to request an
+// interrupt and the request stays pending until the CPU accepts it. Lower
+// numbered lines have priority.
+type Interrupts struct {
+	pending byte
+}
+
+// Raise requests an interrupt on line
+func (ic *Interrupts) Raise(line int) {
+	ic.pending |= 1 << uint(line)
+}
+
+// Pending returns the lines with an interrupt waiting to be accepted
+func (ic *Interrupts) Pending() byte {
+	return ic.pending
+}
+
+// accept returns the highest priority pending line and clears it
+func (ic *Interrupts) accept() (int, bool) {
+	for line := 0; line < NumIRQ; line++ {
+		if ic.pending&(1<<uint(line)) != 0 {
+			ic.pending &^= 1 << uint(line)
+			return line, true
+		}
+	}
+	return 0, false
+}
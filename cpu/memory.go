@@ -1,4 +1,4 @@
-package main
+package cpu
 
 // Memory interface describes the fetch and write methods for the VM
 type Memory interface {
@@ -9,31 +9,33 @@ type Memory interface {
 type StdMemory []byte
 
 // NewBlock returns a new Standard Memory block of at least sz bytes
-// If sz is zero then NewBlock returns the maximum value of a uint16
+// If sz is zero then NewBlock returns a block covering the whole address
+// space
 func NewBlock(sz uint16) StdMemory {
 	if sz == 0 {
-		sz = 0xffff
+		return make(StdMemory, 0x10000)
 	}
 	return make(StdMemory, sz)
 }
 
+// Fetch and Write panic with an *AccessError if addr is outside the block
 func (s StdMemory) Fetch(addr uint16) byte {
-	if uint16(len(s)) <= addr {
-		panic("segfault: address out of bounds")
+	if len(s) <= int(addr) {
+		panic(&AccessError{Addr: addr})
 	}
 	return s[addr]
 }
 
 func (s StdMemory) Write(addr uint16, data byte) {
-	if uint16(len(s)) <= addr {
-		panic("segfault: address out of bounds")
+	if len(s) <= int(addr) {
+		panic(&AccessError{Addr: addr})
 	}
 	s[addr] = data
 }
 
 func (s StdMemory) WriteBlock(addr uint16, data []byte) {
-	if uint16(len(s)) <= addr {
-		panic("segfault: address out of bounds")
+	if len(s) < int(addr)+len(data) {
+		panic(&AccessError{Addr: addr})
 	}
 	copy(s[addr:], data)
 }
@@ -0,0 +1,50 @@
+package cpu
+
+import vm "github.com/rthornton128/vm/lib"
+
+// Trace describes a step of the CPU which executed an instruction or
+// accepted an interrupt
+type Trace struct {
+	PC     uint16     // address of the instruction executed
+	Inst   []byte     // instruction executed, nil if the CPU was waiting
+	Regs   Regs       // registers after the step
+	Writes []MemWrite // memory written during the step, in order
+	IRQ    int        // interrupt line accepted after the instruction, or -1
+	Cycles uint64     // clock cycles executed after the step
+}
+
+// MemWrite is a byte written to memory
+type MemWrite struct {
+	Addr  uint16
+	Value byte
+}
+
+// SetTracer sets fn to be called after each step which executes an
+// instruction or accepts an interrupt. The Trace is only valid for the
+// duration of the call. Passing nil stops tracing.
+func (c *CPU) SetTracer(fn func(*Trace)) {
+	c.tracer = fn
+}
+
+// write writes data to addr, recording it in the trace when tracing
+func (c *CPU) write(addr uint16, data byte) {
+	c.mem.Write(addr, data)
+	if c.trace != nil {
+		c.trace.Writes = append(c.trace.Writes, MemWrite{addr, data})
+	}
+}
+
+// inst returns the bytes of the instruction just fetched, rebuilt from the
+// registers so memory is not read a second time
+func (c *CPU) inst() []byte {
+	op := vm.Opcode(c.ir & 0x3f)
+	switch {
+	case op == vm.CALL:
+		return []byte{c.ir, c.tr, c.dr}
+	case op.Operands() == 2:
+		return []byte{c.ir, byte(c.ar >> 8), byte(c.ar)}
+	case op.Operands() == 1:
+		return []byte{c.ir, c.dr}
+	}
+	return []byte{c.ir}
+}
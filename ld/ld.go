@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/rthornton128/vm/lib"
 )
@@ -20,8 +24,136 @@ func load(b []byte) *vm.Object {
 	return o
 }
 
+// setLayout sets the addresses of the sections and stack which were given
+func setLayout(l *vm.Layout, text, data, stack string) error {
+	for _, s := range []struct {
+		sec  vm.SecType
+		addr string
+	}{{vm.TEXT, text}, {vm.DATA, data}} {
+		if s.addr == "" {
+			continue
+		}
+		a, err := strconv.ParseUint(s.addr, 0, 16)
+		if err != nil {
+			return fmt.Errorf("invalid %s address: %s", s.sec, s.addr)
+		}
+		l.SetBase(s.sec, uint16(a))
+	}
+	if stack == "" {
+		return nil
+	}
+	addr, size := stack, "0"
+	if i := strings.IndexByte(stack, ':'); i >= 0 {
+		addr, size = stack[:i], stack[i+1:]
+	}
+	n, err := strconv.ParseUint(size, 0, 16)
+	if err != nil {
+		return fmt.Errorf("invalid stack size: %s", size)
+	}
+	if addr == "" {
+		l.SetStackSize(uint16(n))
+		return nil
+	}
+	a, err := strconv.ParseUint(addr, 0, 16)
+	if err != nil {
+		return fmt.Errorf("invalid stack address: %s", addr)
+	}
+	l.SetStack(uint16(a), uint16(n))
+	return nil
+}
+
+// merge merges ob, read from the file called name, into o. The entry point
+// ob sets is ignored if one was given on the command line.
+func merge(o, ob *vm.Object, name string, inputs []input, entry string) []input {
+	if entry != "" {
+		ob.HasEntry = false
+	}
+	inputs = append(inputs, newInput(name, o, ob))
+	if err := o.Merge(ob); err != nil {
+		log.Fatalf("%s: %s", name, err)
+	}
+	return inputs
+}
+
+// linkArchive merges the members of an archive which define symbols that
+// are so far undefined, including those only needed by other members
+func linkArchive(o *vm.Object, fname string, b []byte, inputs []input,
+	entry string) []input {
+	a, err := vm.ScanArchive(b)
+	if err != nil {
+		log.Fatalf("%s: %s", fname, err)
+	}
+	loaded := make([]bool, len(a.Members))
+	for {
+		i, ok := a.Needed(o, loaded)
+		if !ok {
+			return inputs
+		}
+		loaded[i] = true
+		m := a.Members[i]
+		ob, err := m.Object()
+		if err != nil {
+			log.Fatalf("%s(%s): %s", fname, m.Name, err)
+		}
+		inputs = merge(o, ob, fname+"("+m.Name+")", inputs, entry)
+	}
+}
+
+// resolve completes the link once every object has been merged into o. It
+// checks nothing is undefined, sets the entry point if one was given and,
+// if gc is set, drops the subroutines which can't be reached, updating
+// where inputs were placed. The subroutines dropped are returned.
+func resolve(o *vm.Object, inputs []input, entry string, gc bool) ([]vm.Symbol, error) {
+	if undef := o.Undefined(); len(undef) > 0 {
+		return nil, fmt.Errorf("undefined symbols: %s", strings.Join(undef, ", "))
+	}
+	if entry != "" {
+		if err := o.SetEntry(entry); err != nil {
+			return nil, err
+		}
+	}
+	if !o.HasEntry {
+		return nil, errors.New("no entry point; use .entry or -e")
+	}
+
+	var dropped []vm.Symbol
+	if gc {
+		var moved []uint16
+		var err error
+		if dropped, moved, err = o.DropUnreachable(); err != nil {
+			return nil, err
+		}
+		for i := range inputs {
+			inputs[i].move(vm.TEXT, moved)
+		}
+	}
+	return dropped, o.CheckLayout()
+}
+
 func main() {
 	out := flag.String("o", "out.vm", "program name")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: ld [flags] object|archive...")
+		fmt.Fprintln(os.Stderr, "archive members are only linked if they "+
+			"define a symbol which is undefined when the archive is reached")
+		flag.PrintDefaults()
+	}
+	strip := flag.Bool("s", false, "strip the symbol and line tables from "+
+		"the program")
+	mapFile := flag.String("Map", "", "write a map of where each object, "+
+		"section and symbol was placed to `file`")
+	entry := flag.String("e", "", "start the program at `symbol` instead of "+
+		"the entry point an object sets")
+	gc := flag.Bool("gc-sections", false, "drop subroutines which can't be "+
+		"reached from the entry point")
+	text := flag.String("Ttext", "", "load the text section at `address`, "+
+		"0 by default")
+	data := flag.String("Tdata", "", "load the data section at `address`, "+
+		"after the text by default")
+	stack := flag.String("stack", "", "place the stack at `address`, after "+
+		"the sections by default, optionally followed by :size to limit its "+
+		"growth, which is otherwise up to the devices; :size alone only "+
+		"limits it")
 	flag.Parse()
 
 	if flag.NArg() == 0 {
@@ -30,6 +162,10 @@ func main() {
 	}
 
 	o := vm.NewObject()
+	if err := setLayout(&o.Layout, *text, *data, *stack); err != nil {
+		log.Fatal(err)
+	}
+	var inputs []input
 	for _, fname := range flag.Args() {
 		f, err := os.Open(fname)
 		if err != nil {
@@ -41,12 +177,32 @@ func main() {
 			log.Fatal(err)
 		}
 
-		if err := o.Merge(load(b)); err != nil {
-			log.Fatal(err)
-		}
 		f.Close()
+
+		if vm.IsArchive(b) {
+			inputs = linkArchive(o, fname, b, inputs, *entry)
+			continue
+		}
+		inputs = merge(o, load(b), fname, inputs, *entry)
 	}
 	//fmt.Println("merged text", o.SecTab[vm.TEXT])
+	dropped, err := resolve(o, inputs, *entry, *gc)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *mapFile != "" {
+		m, err := os.Create(*mapFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writeMap(m, o, inputs, dropped); err != nil {
+			log.Fatal(err)
+		}
+		if err := m.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	f, err := os.Create(*out)
 	if err != nil {
@@ -55,6 +211,9 @@ func main() {
 	defer f.Close()
 
 	prog := vm.NewProgram(o)
+	if *strip {
+		prog.Strip()
+	}
 	//fmt.Println("prog text", prog.SecTab[vm.TEXT])
 	//fmt.Println(prog.Bytes())
 	n, err := f.Write(prog.Bytes())
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"go/token"
+	"strings"
+	"testing"
+
+	"github.com/rthornton128/vm/lib"
+)
+
+// assemble assembles src into an object
+func assemble(t *testing.T, name, src string) *vm.Object {
+	f := token.NewFileSet().AddFile(name, -1, len(src))
+	b := new(bytes.Buffer)
+	if err := vm.NewEncoder(f, b).Encode(strings.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	o, err := vm.ScanObject(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+const (
+	srcA = `.text
+main:
+call $sum
+ret
+dead:
+call $unused
+ret
+.data
+x: .byte 1
+`
+	srcB = `.global sum
+.global unused
+.text
+sum:
+mov %b
+add %c
+ret
+unused:
+ret
+.data
+y: .word 2
+`
+)
+
+func TestLinkMap(t *testing.T) {
+	var tests = []struct {
+		entry string
+		gc    bool
+		m     string
+	}{
+		{"", false, `Sections:
+  NAME  ADDRESS SIZE   OBJECT
+  text  0000    12
+        0000    8      a.o
+        0008    4      b.o
+  data  000c    3
+        000c    1      a.o
+        000d    2      b.o
+
+Symbols:
+  ADDRESS SEC   BIND   NAME
+  0000    text  local  main
+  0004    text  local  dead
+  0008    text  global sum
+  000b    text  global unused
+  000c    data  local  x
+  000d    data  local  y
+
+Stack: 000f up to the devices
+Entry point: 0000
+Memory used: 15 of 65536 bytes (0.0%)
+`},
+		{"", true, `Sections:
+  NAME  ADDRESS SIZE   OBJECT
+  text  0000    7
+        0000    4      a.o
+        0004    3      b.o
+  data  0007    3
+        0007    1      a.o
+        0008    2      b.o
+
+Symbols:
+  ADDRESS SEC   BIND   NAME
+  0000    text  local  main
+  0004    text  global sum
+  0007    data  local  x
+  0008    data  local  y
+
+Discarded:
+  SIZE    BIND   NAME
+  4       local  dead
+  1       global unused
+
+Stack: 000a up to the devices
+Entry point: 0000
+Memory used: 10 of 65536 bytes (0.0%)
+`},
+		// starting at dead keeps it and unused but drops main and sum
+		{"dead", true, `Sections:
+  NAME  ADDRESS SIZE   OBJECT
+  text  0000    5
+        0000    4      a.o
+        0004    1      b.o
+  data  0005    3
+        0005    1      a.o
+        0006    2      b.o
+
+Symbols:
+  ADDRESS SEC   BIND   NAME
+  0000    text  local  dead
+  0004    text  global unused
+  0005    data  local  x
+  0006    data  local  y
+
+Discarded:
+  SIZE    BIND   NAME
+  4       local  main
+  3       global sum
+
+Stack: 0008 up to the devices
+Entry point: 0000
+Memory used: 8 of 65536 bytes (0.0%)
+`},
+	}
+	for _, test := range tests {
+		o := vm.NewObject()
+		inputs := merge(o, assemble(t, "a.a", srcA), "a.o", nil, test.entry)
+		inputs = merge(o, assemble(t, "b.a", srcB), "b.o", inputs, test.entry)
+		dropped, err := resolve(o, inputs, test.entry, test.gc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		if err := writeMap(b, o, inputs, dropped); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != test.m {
+			t.Fatalf("entry %q, gc %v: expected map:\n%s\ngot:\n%s", test.entry,
+				test.gc, test.m, b)
+		}
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	var tests = []struct {
+		src, entry, err string
+	}{
+		{".text\nmain:\ncall $f\nret\n", "", "undefined symbols: f"},
+		{".text\nf:\nret\n", "", "no entry point; use .entry or -e"},
+		{".text\nmain:\nret\n", "g", "entry point not defined: g"},
+	}
+	for _, test := range tests {
+		o := vm.NewObject()
+		inputs := merge(o, assemble(t, "a.a", test.src), "a.o", nil, test.entry)
+		_, err := resolve(o, inputs, test.entry, false)
+		if err == nil || err.Error() != test.err {
+			t.Fatal("expected error", test.err, "got", err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/rthornton128/vm/lib"
+)
+
+// input is an object given to the linker and where its sections were
+// placed, relative to the start of each merged section
+type input struct {
+	name string
+	off  []uint16
+	size []uint16
+}
+
+// newInput records where ob's sections will be placed when merged into o
+func newInput(name string, o, ob *vm.Object) input {
+	in := input{name: name, off: make([]uint16, len(o.SecTab)),
+		size: make([]uint16, len(o.SecTab))}
+	for sec := range o.SecTab {
+		in.off[sec] = uint16(len(o.SecTab[sec]))
+		in.size[sec] = uint16(len(ob.SecTab[sec]))
+	}
+	return in
+}
+
+// move updates the placement of sec after the linker moved each address a
+// in the merged section to moved[a]
+func (in *input) move(sec vm.SecType, moved []uint16) {
+	off, end := in.off[sec], in.off[sec]+in.size[sec]
+	in.off[sec], in.size[sec] = moved[off], moved[end]-moved[off]
+}
+
+// writeMap writes where each input object's sections and every symbol were
+// placed in the linked object o, followed by any subroutines dropped as
+// unreachable, the entry point and memory used
+func writeMap(w io.Writer, o *vm.Object, inputs []input, dropped []vm.Symbol) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintln(bw, "Sections:")
+	fmt.Fprintf(bw, "  %-5s %-7s %-6s %s\n", "NAME", "ADDRESS", "SIZE", "OBJECT")
+	for sec := range o.SecTab {
+		st := vm.SecType(sec)
+		fmt.Fprintf(bw, "  %-5s %04x    %d\n", st, o.Base(st),
+			len(o.SecTab[sec]))
+		for _, in := range inputs {
+			if in.size[sec] > 0 {
+				fmt.Fprintf(bw, "        %04x    %-6d %s\n",
+					o.Base(st)+in.off[sec], in.size[sec], in.name)
+			}
+		}
+	}
+
+	syms := make([]vm.Symbol, len(o.SymTab))
+	copy(syms, o.SymTab)
+	addr := func(s vm.Symbol) uint16 {
+		return o.Base(s.Section()) + s.Address()
+	}
+	sort.SliceStable(syms, func(i, j int) bool {
+		return addr(syms[i]) < addr(syms[j])
+	})
+	fmt.Fprintln(bw, "\nSymbols:")
+	fmt.Fprintf(bw, "  %-7s %-5s %-6s %s\n", "ADDRESS", "SEC", "BIND", "NAME")
+	for _, s := range syms {
+		fmt.Fprintf(bw, "  %04x    %-5s %-6s %s\n", addr(s), s.Section(),
+			s.Binding(), s.Name())
+	}
+
+	if len(dropped) > 0 {
+		fmt.Fprintln(bw, "\nDiscarded:")
+		fmt.Fprintf(bw, "  %-7s %-6s %s\n", "SIZE", "BIND", "NAME")
+		for _, s := range dropped {
+			fmt.Fprintf(bw, "  %-7d %-6s %s\n", s.Len(), s.Binding(), s.Name())
+		}
+	}
+
+	used := 0
+	for _, sec := range o.SecTab {
+		used += len(sec)
+	}
+	sb, size := vm.NewProgram(o).Stack()
+	if size > 0 {
+		fmt.Fprintf(bw, "\nStack: %04x size %d\n", sb, size)
+	} else {
+		fmt.Fprintf(bw, "\nStack: %04x up to the devices\n", sb)
+	}
+	fmt.Fprintf(bw, "Entry point: %04x\n", o.Base(vm.TEXT)+o.Entry)
+	fmt.Fprintf(bw, "Memory used: %d of %d bytes (%.1f%%)\n", used, 0x10000,
+		100*float64(used)/0x10000)
+	return bw.Flush()
+}
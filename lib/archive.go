@@ -0,0 +1,231 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// ArchiveMagic starts every archive
+var ArchiveMagic = []byte("!<vmar>\n")
+
+// Archive is a library of objects along with an index of the global and
+// weak symbols each defines. The linker only merges the members needed to
+// resolve undefined symbols.
+type Archive struct {
+	Members []Member
+	Index   []IndexEntry
+}
+
+// Member is an object in an archive, kept in its encoded form since
+// merging an object modifies it
+type Member struct {
+	Name string
+	Data []byte
+}
+
+// IndexEntry names the member defining a symbol
+type IndexEntry struct {
+	Name   string
+	Member uint16
+}
+
+func NewArchive() *Archive {
+	return &Archive{
+		Members: make([]Member, 0),
+		Index:   make([]IndexEntry, 0),
+	}
+}
+
+// IsArchive reports whether b begins with the archive magic number
+func IsArchive(b []byte) bool {
+	return bytes.HasPrefix(b, ArchiveMagic)
+}
+
+// Object decodes the member's object
+func (m Member) Object() (*Object, error) {
+	return ScanObject(m.Data)
+}
+
+// Add adds the encoded object b under name, replacing any member of the
+// same name, and rebuilds the index. A global symbol defined by two members
+// is an error, as it would be when linking them.
+func (a *Archive) Add(name string, b []byte) error {
+	if len(name) > 0xff {
+		return fmt.Errorf("member name too long: %s", name)
+	}
+	if _, err := ScanObject(b); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	m := Member{Name: name, Data: append([]byte{}, b...)}
+	if i, ok := a.member(name); ok {
+		a.Members[i] = m
+	} else {
+		a.Members = append(a.Members, m)
+	}
+	return a.index()
+}
+
+// Remove removes the member called name
+func (a *Archive) Remove(name string) error {
+	i, ok := a.member(name)
+	if !ok {
+		return fmt.Errorf("no such member: %s", name)
+	}
+	a.Members = append(a.Members[:i], a.Members[i+1:]...)
+	return a.index()
+}
+
+func (a *Archive) member(name string) (int, bool) {
+	for i, m := range a.Members {
+		if m.Name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// index rebuilds the symbol index from the members. Symbols defined by
+// more than one member resolve as they would when linking: the index names
+// the member with the global definition, or else the first weak one, and
+// two globals conflict.
+func (a *Archive) index() error {
+	a.Index = make([]IndexEntry, 0)
+	binds := make(map[string]Binding)
+	for i, m := range a.Members {
+		o, err := m.Object()
+		if err != nil {
+			return fmt.Errorf("%s: %s", m.Name, err)
+		}
+		for _, s := range o.SymTab {
+			if s.sec == UNDEF || s.bind == LOCAL {
+				continue
+			}
+			b, ok := binds[s.name]
+			switch {
+			case !ok:
+				binds[s.name] = s.bind
+				a.Index = append(a.Index, IndexEntry{s.name, uint16(i)})
+			case b == GLOBAL && s.bind == GLOBAL:
+				x, _ := a.Lookup(s.name)
+				return fmt.Errorf("duplicate name: %s defined in %s and %s",
+					s.name, a.Members[x].Name, m.Name)
+			case b == WEAK && s.bind == GLOBAL:
+				binds[s.name] = GLOBAL
+				for j := range a.Index {
+					if a.Index[j].Name == s.name {
+						a.Index[j].Member = uint16(i)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Lookup returns the index of the member defining the symbol called name
+func (a *Archive) Lookup(name string) (int, bool) {
+	for _, e := range a.Index {
+		if e.Name == name {
+			return int(e.Member), true
+		}
+	}
+	return 0, false
+}
+
+// Needed returns the index of a member, not yet loaded, which defines one
+// of the symbols undefined in o
+func (a *Archive) Needed(o *Object, loaded []bool) (int, bool) {
+	for _, name := range o.Undefined() {
+		if i, ok := a.Lookup(name); ok && !loaded[i] {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Bytes encodes the archive as the magic number, the number of index
+// entries followed by each as member and name, then the number of members
+// followed by each as name, size and object
+func (a *Archive) Bytes() []byte {
+	b := append([]byte{}, ArchiveMagic...)
+	b = append(b, toBytes(uint16(len(a.Index)))...)
+	for _, e := range a.Index {
+		b = append(b, toBytes(e.Member)...)
+		b = append(b, byte(len(e.Name)))
+		b = append(b, e.Name...)
+	}
+	b = append(b, toBytes(uint16(len(a.Members)))...)
+	for _, m := range a.Members {
+		b = append(b, byte(len(m.Name)))
+		b = append(b, m.Name...)
+		b = append(b, toBytes(uint16(len(m.Data)))...)
+		b = append(b, m.Data...)
+	}
+	return b
+}
+
+func ScanArchive(b []byte) (*Archive, error) {
+	if !IsArchive(b) {
+		return nil, errors.New("bad magic number, not vm archive")
+	}
+	a := NewArchive()
+	r := &archiveReader{b: b, off: len(ArchiveMagic)}
+
+	n := r.uint16()
+	for i := uint16(0); i < n && r.err == nil; i++ {
+		e := IndexEntry{Member: r.uint16()}
+		e.Name = string(r.next(int(r.byte())))
+		a.Index = append(a.Index, e)
+	}
+	n = r.uint16()
+	for i := uint16(0); i < n && r.err == nil; i++ {
+		m := Member{Name: string(r.next(int(r.byte())))}
+		m.Data = append([]byte{}, r.next(int(r.uint16()))...)
+		a.Members = append(a.Members, m)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	for _, e := range a.Index {
+		if int(e.Member) >= len(a.Members) {
+			return nil, fmt.Errorf("invalid archive index for %s", e.Name)
+		}
+	}
+	return a, nil
+}
+
+// archiveReader reads the fields of an archive, remembering the first
+// error so it need only be checked once
+type archiveReader struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (r *archiveReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if r.off+n > len(r.b) {
+		r.err = errors.New("truncated archive")
+		return nil
+	}
+	b := r.b[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *archiveReader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *archiveReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return toAddress(b)
+	}
+	return 0
+}
@@ -0,0 +1,81 @@
+package vm_test
+
+import (
+	"testing"
+
+	vm "github.com/rthornton128/vm/lib"
+)
+
+func TestArchive(t *testing.T) {
+	a := vm.NewArchive()
+	for name, src := range map[string]string{
+		"sq.o":     ".global square\n.extern mul\n.text\nsquare:\ncall $mul\nret\n",
+		"mul.o":    ".global mul\n.text\nmul:\nmul %b\nret\n",
+		"unused.o": ".global unused\n.text\nunused:\nret\n",
+	} {
+		if err := a.Add(name, encode(t, src).Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Add("dup.o", encode(t, ".global mul\n.text\nmul:\nret\n").Bytes()); err == nil {
+		t.Fatal("expected duplicate symbol error")
+	}
+	a.Remove("dup.o")
+
+	a, err := vm.ScanArchive(a.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Members) != 3 || len(a.Index) != 3 {
+		t.Fatal("expected 3 members and index entries, got", a.Members, a.Index)
+	}
+
+	// only the members needed to resolve square, and what it needs, load
+	o := vm.NewObject()
+	if err := o.Merge(encode(t, ".extern square\n.text\nmain:\ncall $square\nret\n")); err != nil {
+		t.Fatal(err)
+	}
+	loaded := make([]bool, len(a.Members))
+	var names []string
+	for {
+		i, ok := a.Needed(o, loaded)
+		if !ok {
+			break
+		}
+		loaded[i] = true
+		names = append(names, a.Members[i].Name)
+		ob, err := a.Members[i].Object()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := o.Merge(ob); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(names) != 2 || names[0] != "sq.o" || names[1] != "mul.o" {
+		t.Fatal("expected sq.o and mul.o to be linked, got", names)
+	}
+	if undef := o.Undefined(); len(undef) != 0 {
+		t.Fatal("expected no undefined symbols, got", undef)
+	}
+
+	// weak symbols may be defined by several members, with the index naming
+	// the global definition if there is one
+	w := vm.NewArchive()
+	for _, m := range []struct{ name, src string }{
+		{"w1.o", ".weak f\n.text\nf:\nret\n"},
+		{"w2.o", ".weak f\n.text\nf:\nret\n"},
+		{"g.o", ".global f\n.text\nf:\nret\n"},
+	} {
+		if err := w.Add(m.name, encode(t, m.src).Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if i, ok := w.Lookup("f"); !ok || w.Members[i].Name != "g.o" {
+		t.Fatal("expected f to be indexed in g.o, got", w.Index)
+	}
+
+	if _, err := vm.ScanArchive(a.Bytes()[:20]); err == nil {
+		t.Fatal("expected truncated archive error")
+	}
+}
@@ -1,5 +1,10 @@
 package vm
 
+import (
+	"errors"
+	"go/token"
+)
+
 type Section interface {
 	//Name() string
 	//Data() interface{}
@@ -8,17 +13,99 @@ type Section interface {
 type (
 	File struct {
 		sections []Section
+		decls    []*Decl
+		entries  []*Decl // .entry directives, of which there may be one
 		//magic []byte
 		stab map[string]int
 	}
+	// Decl declares the binding of a symbol with a .global, .weak or
+	// .extern directive
+	Decl struct {
+		Name   string
+		Bind   Binding
+		Extern bool
+		Pos    token.Pos
+	}
+	// Ref refers to a symbol's address, or part of it, plus an optional
+	// addend, which the linker fills in
+	Ref struct {
+		Type   RelocType
+		Name   string
+		Addend string
+		Pos    token.Pos
+	}
 	Instruction struct {
 		Op    Opcode
-		Value string
+		Value string // literal operand
+		Ref   *Ref   // symbol operand, used in place of Value
+		Pos   token.Pos
+	}
+	Data struct {
+		Name   string
+		Type   DataType
+		Values []string
+		Refs   []*Ref // symbol used in place of each value, if any
+		Pos    token.Pos
 	}
 	DataSection struct {
-		m map[string]byte
+		d []*Data
+	}
+	Sub struct {
+		Name  string // empty for instructions preceding the first label
+		Pos   token.Pos
+		Insts []*Instruction
 	}
 	TextSection struct {
-		m map[string][]*Instruction
+		subs []*Sub // in source order
+	}
+)
+
+// Size returns the number of bytes the instruction is encoded in
+func (i *Instruction) Size() uint16 {
+	return uint16(1 + (i.Op & 0x3f).Operands())
+}
+
+// Size returns the number of bytes the initialiser occupies in the data
+// section
+func (d *Data) Size() uint16 {
+	switch d.Type {
+	case BYTE:
+		return uint16(len(d.Values))
+	case WORD:
+		return uint16(2 * len(d.Values))
 	}
+	var n int
+	for _, v := range d.Values {
+		n += len(v) + 1
+	}
+	return uint16(n)
+}
+
+// DataType describes how the values of a data initialiser are laid out in
+// the data section
+type DataType byte
+
+const (
+	BYTE   DataType = iota // one byte per value
+	WORD                   // two bytes per value, most significant first
+	STRING                 // string bytes followed by a terminating zero
 )
+
+var datatypes = map[DataType]string{
+	BYTE:   "byte",
+	WORD:   "word",
+	STRING: "string",
+}
+
+func (t DataType) String() string {
+	return datatypes[t]
+}
+
+func LookupDataType(s string) (DataType, error) {
+	for k, v := range datatypes {
+		if s == v {
+			return k, nil
+		}
+	}
+	return 0, errors.New("invalid data type: " + s)
+}
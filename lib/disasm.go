@@ -0,0 +1,203 @@
+package vm
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Inst is a single decoded instruction
+type Inst struct {
+	Addr    uint16   // address of the opcode
+	Op      Opcode   // opcode without register bits
+	Reg     Register // register operand, if Op.HasRegister()
+	Operand uint16   // address or immediate operand, if any
+	Bytes   []byte   // raw encoding, including operands
+	Symbol  string   // symbol an operand refers to, if known
+	Illegal bool     // Bytes does not hold a valid instruction
+}
+
+// Decode decodes the instruction at the start of b, which is located at
+// addr. An error is returned if b does not start with a valid instruction,
+// in which case the returned Inst holds the single offending byte.
+func Decode(b []byte, addr uint16) (Inst, error) {
+	if len(b) == 0 {
+		return Inst{Addr: addr, Illegal: true}, fmt.Errorf("%04x: no bytes", addr)
+	}
+	bad := Inst{Addr: addr, Bytes: b[:1], Illegal: true}
+	op, reg := Opcode(b[0]&0x3f), Register(b[0]&0xc0)
+	if !op.Valid() {
+		return bad, fmt.Errorf("%04x: illegal instruction %#02x", addr, b[0])
+	}
+	if !op.ValidRegister(reg) {
+		return bad, fmt.Errorf("%04x: illegal register bits %#02x", addr, b[0])
+	}
+
+	n := 1 + op.Operands()
+	if len(b) < n {
+		return bad, fmt.Errorf("%04x: truncated instruction %s", addr, op)
+	}
+	i := Inst{Addr: addr, Op: op, Reg: reg, Bytes: b[:n]}
+	switch op.Operands() {
+	case 1:
+		i.Operand = uint16(b[1])
+	case 2:
+		i.Operand = toAddress(b[1:3])
+	}
+	return i, nil
+}
+
+// Disassemble decodes text, which is loaded at addr, into instructions.
+// Address operands are named using m, which may be nil. Bytes which do not
+// decode are returned as illegal instructions, one byte at a time.
+func Disassemble(text []byte, addr uint16, m *AddressMap) []Inst {
+	il := make([]Inst, 0)
+	for off := 0; off < len(text); {
+		i, _ := Decode(text[off:], addr+uint16(off))
+		if m != nil && i.Op.Operands() == 2 && !i.Illegal {
+			if _, _, ok := m.Lookup(i.Operand); ok {
+				i.Symbol = m.Name(i.Operand)
+			}
+		}
+		il = append(il, i)
+		off += len(i.Bytes)
+	}
+	return il
+}
+
+// Disassemble decodes the text section of an unlinked object. Operands
+// which the linker will fill in are named from the relocation table since
+// the addresses in the text are only placeholders.
+func (o *Object) Disassemble() []Inst {
+	il := Disassemble(o.SecTab[TEXT], 0, nil)
+	relocs := make(map[uint16]RelocAddr)
+	for _, r := range o.RelocTab {
+		if r.sec == TEXT {
+			relocs[r.offset] = r
+		}
+	}
+	for j, i := range il {
+		r, ok := relocs[i.Addr+1]
+		if !ok || int(r.index) >= len(o.SymTab) || i.Op.Operands() != r.typ.Size() {
+			continue
+		}
+		il[j].Symbol = r.Ref(o.SymTab[r.index].name)
+		if r.typ == ABS16 {
+			// String adds the dollar sign to address operands
+			il[j].Symbol = il[j].Symbol[1:]
+		}
+	}
+	return il
+}
+
+// String returns the instruction in assembly syntax
+func (i Inst) String() string {
+	if i.Illegal {
+		if len(i.Bytes) == 0 {
+			return ".byte"
+		}
+		return fmt.Sprintf(".byte %#02x", i.Bytes[0])
+	}
+	switch {
+	case i.Op.HasRegister():
+		return fmt.Sprintf("%s %%%s", i.Op, i.Reg)
+	case i.Op.Operands() == 1 && i.Symbol != "":
+		return fmt.Sprintf("%s %s", i.Op, i.Symbol)
+	case i.Op.Operands() == 1:
+		return fmt.Sprintf("%s %d", i.Op, int8(i.Operand))
+	case i.Op.Operands() == 2 && i.Symbol != "":
+		return fmt.Sprintf("%s $%s", i.Op, i.Symbol)
+	case i.Op.Operands() == 2:
+		return fmt.Sprintf("%s %#04x", i.Op, i.Operand)
+	}
+	return i.Op.String()
+}
+
+// AddressMap names absolute addresses after the symbols at or before them
+type AddressMap struct {
+	syms []mapSym // sorted by address, then name
+}
+
+type mapSym struct {
+	name string
+	addr uint16
+	size uint16
+}
+
+// NewAddressMap returns a map of the symbols in st, whose addresses are
+// relative to the sections loaded at secs. Each symbol names only the bytes
+// it labels, so its size must have been set by linking.
+func NewAddressMap(st SymbolTable, secs Bases) *AddressMap {
+	m := new(AddressMap)
+	for _, s := range st {
+		if s.sec != UNDEF {
+			m.Add(s.name, secs.Base(s.sec)+s.addr, s.size)
+		}
+	}
+	return m
+}
+
+// Add adds a symbol at an absolute address, labelling size bytes, to the
+// map
+func (m *AddressMap) Add(name string, addr, size uint16) {
+	i := sort.Search(len(m.syms), func(i int) bool {
+		s := m.syms[i]
+		return s.addr > addr || (s.addr == addr && s.name >= name)
+	})
+	m.syms = append(m.syms, mapSym{})
+	copy(m.syms[i+1:], m.syms[i:])
+	m.syms[i] = mapSym{name: name, addr: addr, size: size}
+}
+
+// Address returns the address of the symbol called name
+func (m *AddressMap) Address(name string) (uint16, bool) {
+	for _, s := range m.syms {
+		if s.name == name {
+			return s.addr, true
+		}
+	}
+	return 0, false
+}
+
+// Lookup returns the nearest symbol at or before addr and the offset of
+// addr from it. A symbol only matches addresses beyond its own within the
+// bytes it labels.
+func (m *AddressMap) Lookup(addr uint16) (string, uint16, bool) {
+	i := sort.Search(len(m.syms), func(i int) bool {
+		return m.syms[i].addr > addr
+	})
+	if i == 0 {
+		return "", 0, false
+	}
+	// prefer the alphabetically first name at an address for stable output
+	s := m.syms[i-1]
+	for i > 1 && m.syms[i-2].addr == s.addr {
+		i--
+		s = m.syms[i-1]
+	}
+	if off := addr - s.addr; off > 0 && off >= s.size {
+		return "", 0, false
+	}
+	return s.name, addr - s.addr, true
+}
+
+// Name returns addr in the form symbol or symbol+offset, or as a hex
+// number if no symbol labels it
+func (m *AddressMap) Name(addr uint16) string {
+	name, off, ok := m.Lookup(addr)
+	switch {
+	case !ok:
+		return fmt.Sprintf("%#04x", addr)
+	case off == 0:
+		return name
+	}
+	return fmt.Sprintf("%s+%d", name, off)
+}
+
+// Symbols returns the names in the map ordered by address
+func (m *AddressMap) Symbols() []string {
+	names := make([]string, len(m.syms))
+	for i, s := range m.syms {
+		names[i] = s.name
+	}
+	return names
+}
@@ -0,0 +1,59 @@
+package vm_test
+
+import (
+	"testing"
+
+	vm "github.com/rthornton128/vm/lib"
+)
+
+func TestDisassemble(t *testing.T) {
+	text := []byte{
+		byte(vm.ADD) | byte(vm.REGC),
+		byte(vm.MVI), 0xff,
+		byte(vm.CALL), 0x0, 0x0,
+		byte(vm.LDA), 0x0, 0x8,
+		0x3f,
+	}
+	m := new(vm.AddressMap)
+	m.Add("main", 0x0, 0x9)
+
+	expect := []string{"add %c", "mvi -1", "call $main", "lda $main+8",
+		".byte 0x3f"}
+	il := vm.Disassemble(text, 0, m)
+	if len(il) != len(expect) {
+		t.Fatal("expected", len(expect), "instructions, got", len(il))
+	}
+	for i, inst := range il {
+		if inst.String() != expect[i] {
+			t.Fatal("expected", expect[i], "got", inst.String())
+		}
+	}
+	if !il[len(il)-1].Illegal {
+		t.Fatal("expected illegal instruction")
+	}
+
+	// addresses beyond the bytes a symbol labels aren't named after it
+	if il := vm.Disassemble([]byte{byte(vm.STA), 0x0, 0x9}, 0, m); il[0].String() != "sta 0x0009" {
+		t.Fatal("expected sta 0x0009, got", il[0].String())
+	}
+
+	if _, err := vm.Decode([]byte{byte(vm.JMP), 0x0}, 0); err == nil {
+		t.Fatal("expected error, got none")
+	}
+}
+
+func TestObjectDisassemble(t *testing.T) {
+	o := encode(t, `.text
+main:
+jmp $main
+lda $x
+.data
+x: .byte 1
+`)
+	expect := []string{"jmp $main", "lda $x"}
+	for i, inst := range o.Disassemble() {
+		if inst.String() != expect[i] {
+			t.Fatal("expected", expect[i], "got", inst.String())
+		}
+	}
+}
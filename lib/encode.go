@@ -2,32 +2,34 @@ package vm
 
 import (
 	"bytes"
+	"fmt"
 	"go/token"
 	"io"
 	"log"
 	"strconv"
+	"strings"
 )
 
 type Encoder struct {
 	io.Writer
-	buf *bytes.Buffer
-	f   *token.File
-	ob  *Object
+	buf    *bytes.Buffer
+	f      *token.File
+	ob     *Object
+	errors ErrorList
+	list   []listItem
 }
 
 func NewEncoder(f *token.File, w io.Writer) *Encoder {
 	return &Encoder{Writer: w, buf: new(bytes.Buffer), f: f, ob: NewObject()}
 }
 
+// Encode assembles the source read from r and writes the resulting object.
+// Errors in the source are returned as an ErrorList and no object is
+// written.
 func (e *Encoder) Encode(r io.Reader) error {
-	f, errs := Parse(e.f, r)
-	// TODO need error list satisfying error interface
-	if len(errs) > 0 {
-		for _, err := range errs {
-			log.Println(err)
-		}
-		// TODO bad, should return error, see previous todo
-		log.Fatal("failed to assemble file")
+	f, err := Parse(e.f, r)
+	if err != nil {
+		return err
 	}
 
 	// generate text & data bytes
@@ -35,12 +37,13 @@ func (e *Encoder) Encode(r io.Reader) error {
 		return err
 	}
 
-	_, err := e.Write(e.ob.Bytes())
-	if err != nil {
-		log.Fatal(err)
-	}
+	_, err = e.Write(e.ob.Bytes())
+	return err
+}
 
-	return nil
+func (e *Encoder) error(pos token.Pos, args ...interface{}) {
+	e.errors.Add(e.f.Position(pos),
+		strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
 }
 
 func (e *Encoder) emit(b ...byte) {
@@ -54,54 +57,242 @@ func (e *Encoder) emit(b ...byte) {
 }
 
 func (e *Encoder) file(f *File) error {
-	if len(f.sections) > 0 {
-		e.sections(f.sections)
+	// first pass assigns every label an address so that any label may be
+	// referred to before it is declared
+	e.layout(f.sections)
+	e.declare(f.decls)
+	e.entry(f.entries)
+
+	// second pass emits text & data in source order
+	data := new(bytes.Buffer)
+	var hasText, hasData bool
+	for _, s := range f.sections {
+		switch x := s.(type) {
+		case *TextSection:
+			hasText = true
+			for _, sub := range x.subs {
+				if sub.Name != "" {
+					e.listed(sub.Pos, TEXT, e.buf.Len(), nil, len(e.ob.RelocTab))
+				}
+				e.sub(sub.Insts)
+			}
+		case *DataSection:
+			hasData = true
+			for _, d := range x.d {
+				nrel := len(e.ob.RelocTab)
+				b := e.data(d, data.Len())
+				e.listed(d.Pos, DATA, data.Len(), b, nrel)
+				data.Write(b)
+			}
+		default:
+			e.error(token.NoPos, "unexpected section type")
+		}
+	}
+	if hasText {
+		e.ob.setSection(TEXT, e.buf.Bytes())
+		e.ob.LineTab.End(uint16(e.buf.Len()))
 	}
-	return nil
+	if hasData {
+		e.ob.setSection(DATA, data.Bytes())
+	}
+
+	e.errors.RemoveMultiples()
+	return e.errors.Err()
 }
 
-// TODO horrific, section handling needs massive (re)work
-func (e *Encoder) sections(secs []Section) {
+// layout adds a symbol for every label to the symbol table. Labels are
+// addressed relative to the start of their section, with multiple sections
+// of the same type laid out one after the other.
+func (e *Encoder) layout(secs []Section) {
+	var text, data uint16
 	for _, s := range secs {
 		switch x := s.(type) {
 		case *TextSection:
-			for k, v := range x.m {
-				addr := uint16(e.buf.Len())
-				e.ob.AddSymbol(k, TEXT, addr)
-				//fmt.Println("new symbol:", k, addr)
-				e.sub(v)
+			for _, sub := range x.subs {
+				if sub.Name != "" {
+					e.label(sub.Pos, sub.Name, TEXT, text)
+				}
+				for _, i := range sub.Insts {
+					text += i.Size()
+				}
+			}
+		case *DataSection:
+			for _, d := range x.d {
+				e.label(d.Pos, d.Name, DATA, data)
+				data += d.Size()
 			}
-			e.ob.setSection(TEXT, e.buf.Bytes())
-		default:
-			log.Fatal("unexpected section type")
 		}
 	}
-	//fmt.Println(e.stab)
-	return
 }
 
-func (e *Encoder) sub(il []*Instruction) {
-	for _, i := range il {
-		switch i.Op {
-		case JMP, JPZ, JNZ, CALL:
-			// TODO replace
-			s, ok := e.ob.SymTab.Lookup(i.Value) //e.stab[i.Value]
-			if !ok {
-				log.Fatal("undeclared symbol", i.Value)
+// label adds a local symbol, which may later be declared global or weak
+func (e *Encoder) label(pos token.Pos, name string, sec SecType, addr uint16) {
+	if _, err := e.ob.AddSymbol(name, sec, addr); err != nil {
+		e.error(pos, err)
+		return
+	}
+	e.ob.Bind(name, LOCAL)
+}
+
+// declare sets the binding of each declared symbol. Declared symbols which
+// aren't labels in this file are added as undefined. An extern must not be
+// a label in this file.
+func (e *Encoder) declare(decls []*Decl) {
+	for _, d := range decls {
+		s, ok := e.ob.SymTab.Lookup(d.Name)
+		switch {
+		case !ok:
+			if _, err := e.ob.AddSymbol(d.Name, UNDEF, 0); err != nil {
+				e.error(d.Pos, err)
+				continue
+			}
+		case d.Extern && s.sec != UNDEF:
+			e.error(d.Pos, "extern symbol defined in this file:", d.Name)
+			continue
+		}
+		if !d.Extern {
+			e.ob.Bind(d.Name, d.Bind)
+		}
+	}
+}
+
+// entry sets the entry point to the label named by the .entry directive or,
+// without one, to main if it is a label in the text
+func (e *Encoder) entry(entries []*Decl) {
+	if len(entries) > 1 {
+		e.error(entries[1].Pos, "duplicate .entry directive")
+	}
+	if len(entries) == 0 {
+		if s, ok := e.ob.SymTab.Lookup("main"); ok && s.sec == TEXT {
+			e.ob.SetEntry("main")
+		}
+		return
+	}
+	if err := e.ob.SetEntry(entries[0].Name); err != nil {
+		e.error(entries[0].Pos, err)
+	}
+}
+
+// data returns the bytes of an initialiser at off in the data section
+func (e *Encoder) data(d *Data, off int) []byte {
+	b := make([]byte, 0)
+	for i, v := range d.Values {
+		if i < len(d.Refs) && d.Refs[i] != nil {
+			size := 1
+			if d.Type == WORD {
+				size = 2
 			}
-			//fmt.Println(e.ob.LookupSymbolIndex(i.Value), e.buf.Len()+1)
-			e.ob.AddRelocate(e.ob.LookupSymbolIndex(i.Value), uint16(e.buf.Len()+1))
-			b := toBytes(s.Address())
-			e.emit(byte(i.Op), b[0], b[1])
-		case MVI:
-			v, err := strconv.ParseInt(i.Value, 0, 8)
+			b = append(b, e.ref(d.Refs[i], DATA, off+len(b), size)...)
+			continue
+		}
+		switch d.Type {
+		case BYTE:
+			n, err := parseValue(v, 8)
 			if err != nil {
-				log.Fatal(err)
+				e.error(d.Pos, err)
 			}
-			e.emit(byte(i.Op), byte(v))
-		default:
-			e.emit(byte(i.Op))
+			b = append(b, byte(n))
+		case WORD:
+			n, err := parseValue(v, 16)
+			if err != nil {
+				e.error(d.Pos, err)
+			}
+			b = append(b, toBytes(n)...)
+		case STRING:
+			b = append(b, v...)
+			b = append(b, 0)
+		}
+	}
+	return b
+}
+
+// parseValue parses an integer literal which must fit within the given
+// number of bits as either a signed or unsigned value
+func parseValue(s string, bits uint) (uint16, error) {
+	n, err := strconv.ParseInt(s, 0, 32)
+	if err != nil {
+		return 0, err
+	}
+	if n < -(1<<(bits-1)) || n >= 1<<bits {
+		return 0, fmt.Errorf("value out of range for %d bits: %s", bits, s)
+	}
+	return uint16(n), nil
+}
+
+func (e *Encoder) sub(il []*Instruction) {
+	for _, i := range il {
+		start, nrel := e.buf.Len(), len(e.ob.RelocTab)
+		if pos := e.f.Position(i.Pos); pos.IsValid() {
+			e.ob.LineTab.Add(uint16(start), pos.Filename, pos.Line)
+		}
+		e.inst(i)
+		e.listed(i.Pos, TEXT, start, e.buf.Bytes()[start:], nrel)
+	}
+}
+
+func (e *Encoder) inst(i *Instruction) {
+	if i.Ref != nil {
+		e.emit(byte(i.Op))
+		e.emit(e.ref(i.Ref, TEXT, e.buf.Len(), i.Op.Operands())...)
+		return
+	}
+	switch i.Op {
+	case LDA, STA:
+		// absolute addresses need no relocation
+		v, err := parseValue(i.Value, 16)
+		if err != nil {
+			e.error(i.Pos, err)
+		}
+		b := toBytes(v)
+		e.emit(byte(i.Op), b[0], b[1])
+	case MVI:
+		v, err := parseValue(i.Value, 8)
+		if err != nil {
+			e.error(i.Pos, err)
+		}
+		e.emit(byte(i.Op), byte(v))
+	default:
+		e.emit(byte(i.Op))
+	}
+}
+
+// ref returns the size bytes at off in sec which refer to a symbol and
+// records a relocation so the linker can fill in the address. A symbol not
+// declared in this file is added as undefined for the linker to resolve.
+// Until then the bytes hold the symbol's address within this object.
+func (e *Encoder) ref(r *Ref, sec SecType, off, size int) []byte {
+	if r.Type.Size() != size {
+		e.error(r.Pos, fmt.Sprintf("%s reference to %s does not fit a %d-bit "+
+			"operand", r.Type, r.Name, 8*size))
+		return make([]byte, size)
+	}
+	var addend uint16
+	if r.Addend != "" {
+		var err error
+		if addend, err = parseValue(r.Addend, 16); err != nil {
+			e.error(r.Pos, err)
+		}
+	}
+	s, ok := e.ob.SymTab.Lookup(r.Name)
+	if !ok {
+		if _, err := e.ob.AddSymbol(r.Name, UNDEF, 0); err != nil {
+			e.error(r.Pos, err)
+			return make([]byte, size)
+		}
+	}
+	e.ob.AddRelocateType(sec, r.Type, e.ob.LookupSymbolIndex(r.Name),
+		uint16(off), int16(addend))
+	v := s.Address() + addend
+	switch r.Type {
+	case LO8:
+		return []byte{byte(v)}
+	case HI8:
+		return []byte{byte(v >> 8)}
+	case PC8:
+		if s.sec != sec {
+			return []byte{0}
 		}
+		return []byte{byte(v - uint16(off))}
 	}
-	return
+	return toBytes(v)
 }
@@ -1,5 +1,183 @@
 package vm_test
 
+import (
+	"bytes"
+	"go/token"
+	"strings"
+	"testing"
+
+	vm "github.com/rthornton128/vm/lib"
+)
+
+func encode(t *testing.T, src string) *vm.Object {
+	fset := token.NewFileSet()
+	f := fset.AddFile("test.a", -1, len(src))
+	b := new(bytes.Buffer)
+	e := vm.NewEncoder(f, b)
+	if err := e.Encode(strings.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	o, err := vm.ScanObject(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestEncodeData(t *testing.T) {
+	o := encode(t, `.data
+one: .byte 1, 0xff, -1
+two: .word 0x1234
+msg: .string "hi"
+list: .string "a", "", "bc"
+end: .byte 7
+`)
+
+	expect := []byte{0x1, 0xff, 0xff, 0x12, 0x34, 'h', 'i', 0x0, 'a', 0x0, 0x0,
+		'b', 'c', 0x0, 0x7}
+	if !bytes.Equal(o.SecTab[vm.DATA], expect) {
+		t.Fatal("expected", expect, "got", o.SecTab[vm.DATA])
+	}
+
+	for name, addr := range map[string]uint16{"one": 0, "two": 3, "msg": 5,
+		"list": 8, "end": 14} {
+		s, ok := o.SymTab.Lookup(name)
+		if !ok {
+			t.Fatal("missing symbol", name)
+		}
+		if s.Address() != addr {
+			t.Fatal("expected", name, "at", addr, "got", s.Address())
+		}
+	}
+}
+
+func TestEncodeLoadStore(t *testing.T) {
+	o := encode(t, `.text
+main:
+lda $x
+sta 0x1234
+ldax
+.data
+x: .byte 1
+`)
+
+	expect := []byte{byte(vm.LDA), 0x0, 0x0, byte(vm.STA), 0x12, 0x34,
+		byte(vm.LDAX)}
+	if !bytes.Equal(o.SecTab[vm.TEXT], expect) {
+		t.Fatal("expected", expect, "got", o.SecTab[vm.TEXT])
+	}
+	if len(o.RelocTab) != 1 {
+		t.Fatal("expected 1 relocation, got", len(o.RelocTab))
+	}
+}
+
+func TestEncodeInterrupts(t *testing.T) {
+	o := encode(t, `.text
+vectors:
+jmp $tick
+main:
+liv $vectors
+ei
+di
+tick:
+reti
+`)
+
+	expect := []byte{byte(vm.JMP), 0x0, 0x8, byte(vm.LIV), 0x0, 0x0,
+		byte(vm.EI), byte(vm.DI), byte(vm.RETI)}
+	if !bytes.Equal(o.SecTab[vm.TEXT], expect) {
+		t.Fatal("expected", expect, "got", o.SecTab[vm.TEXT])
+	}
+	if len(o.RelocTab) != 2 {
+		t.Fatal("expected 2 relocations, got", len(o.RelocTab))
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	for _, test := range []struct {
+		src   string
+		lines []int
+	}{
+		{".text\nmain:\nfoo\nadd %x\n.bogus\n", []int{3, 4, 5}},
+		{".text\nmain:\nmvi 300\n.data\nx: .byte 1\nx: .byte 2\nmain: .byte 3\n",
+			[]int{3, 6, 7}},
+		{".text\nmain:\nmvi $main\njmp lo($main)\n.data\nx: .byte $main\n",
+			[]int{3, 4, 6}},
+	} {
+		fset := token.NewFileSet()
+		f := fset.AddFile("test.a", -1, len(test.src))
+		e := vm.NewEncoder(f, new(bytes.Buffer))
+		err := e.Encode(strings.NewReader(test.src))
+		list, ok := err.(vm.ErrorList)
+		if !ok {
+			t.Fatal("expected error list, got", err)
+		}
+		if len(list) != len(test.lines) {
+			t.Fatal("expected", len(test.lines), "errors, got", list)
+		}
+		for i, e := range list {
+			if e.Pos.Line != test.lines[i] {
+				t.Fatal("expected error on line", test.lines[i], "got", e)
+			}
+		}
+	}
+}
+
+func TestEncodeForward(t *testing.T) {
+	src := `.text
+main:
+call $sub
+jmp $ext
+sub:
+ret
+`
+	o := encode(t, src)
+	expect := []byte{byte(vm.CALL), 0x0, 0x6, byte(vm.JMP), 0x0, 0x0,
+		byte(vm.RET)}
+	if !bytes.Equal(o.SecTab[vm.TEXT], expect) {
+		t.Fatal("expected", expect, "got", o.SecTab[vm.TEXT])
+	}
+
+	// layout must not depend on map iteration order
+	for i := 0; i < 10; i++ {
+		if !bytes.Equal(encode(t, src).Bytes(), o.Bytes()) {
+			t.Fatal("layout differs between runs")
+		}
+	}
+
+	if u := o.Undefined(); len(u) != 1 || u[0] != "ext" {
+		t.Fatal("expected ext to be undefined, got", u)
+	}
+}
+
+func TestEncodeDirectives(t *testing.T) {
+	o := encode(t, `.global main, count
+.extern lib
+.text
+main:
+call $lib
+loop:
+jmp $loop
+.data
+count: .byte 0
+`)
+	for name, bind := range map[string]vm.Binding{
+		"main": vm.GLOBAL, "loop": vm.LOCAL, "count": vm.GLOBAL,
+		"lib": vm.GLOBAL,
+	} {
+		s, ok := o.SymTab.Lookup(name)
+		if !ok {
+			t.Fatal("missing symbol", name)
+		}
+		if s.Binding() != bind {
+			t.Fatal("expected", name, "to be", bind, "got", s.Binding())
+		}
+	}
+	if s, _ := o.SymTab.Lookup("lib"); s.Section() != vm.UNDEF {
+		t.Fatal("expected lib to be undefined, got", s.Section())
+	}
+}
+
 /*
 func TestEncodeMinimal(t *testing.T) {
 	b := new(bytes.Buffer)
@@ -86,3 +264,176 @@ func TestRegisters(t *testing.T) {
 		t.Fatal("expected error, got none")
 	}
 }*/
+
+func TestEncodeLines(t *testing.T) {
+	o := encode(t, `.text
+main:
+mvi 1
+call $f
+ret
+f:
+ret
+`)
+	for addr, line := range map[uint16]int{0: 3, 1: 3, 2: 4, 5: 5, 6: 7} {
+		file, l, ok := o.LineTab.Lookup(addr)
+		if !ok || file != "test.a" || l != line {
+			t.Fatal("expected", addr, "at test.a:", line, "got", file, l, ok)
+		}
+	}
+	if _, _, ok := o.LineTab.Lookup(7); ok {
+		t.Fatal("expected no line past the end of text")
+	}
+
+	// lines move with the text when objects are merged
+	m := vm.NewObject()
+	if err := m.Merge(o, encode(t, ".text\ng:\nret\n")); err != nil {
+		t.Fatal(err)
+	}
+	p, err := vm.ScanProgram(vm.NewProgram(m).Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos := p.Lines().Position(7); pos != "test.a:3" {
+		t.Fatal("expected test.a:3, got", pos)
+	}
+	if pos := p.Lines().Position(5); pos != "test.a:5" {
+		t.Fatal("expected test.a:5, got", pos)
+	}
+}
+
+func TestListing(t *testing.T) {
+	src := `.text
+main:
+call $f
+ret
+.data
+x: .byte 1
+tab: .word $main, $tab+2, 7
+`
+	fset := token.NewFileSet()
+	f := fset.AddFile("test.a", -1, len(src))
+	e := vm.NewEncoder(f, new(bytes.Buffer))
+	if err := e.Encode(strings.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	if err := e.Listing(out, []byte(src)); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"    3 text:0000 04 00 00 R     call $f",
+		"    4 text:0003 05             ret",
+		"    6 data:0000 01             x: .byte 1",
+		"    7 data:0001 00 00 00 03 R  tab: .word $main, $tab+2, 7",
+		"      data:0005 00 07",
+		"  0000 undef global f",
+	} {
+		if !strings.Contains(out.String(), want+"\n") {
+			t.Fatalf("expected %q in listing:\n%s", want, out)
+		}
+	}
+}
+
+func TestEncodeEntry(t *testing.T) {
+	o := encode(t, ".text\nmain:\nret\n")
+	if !o.HasEntry || o.Entry != 0 {
+		t.Fatal("expected main at 0 to be the entry point, got", o.HasEntry, o.Entry)
+	}
+	o = encode(t, ".entry start\n.text\nmain:\nret\nstart:\nret\n")
+	if !o.HasEntry || o.Entry != 1 {
+		t.Fatal("expected start to be the entry point, got", o.HasEntry, o.Entry)
+	}
+	if o = encode(t, ".text\nf:\nret\n"); o.HasEntry {
+		t.Fatal("expected no entry point")
+	}
+
+	// objects setting the entry point can't be linked together
+	m := vm.NewObject()
+	err := m.Merge(encode(t, ".text\nmain:\nret\n"),
+		encode(t, ".entry f\n.text\nf:\nret\n"))
+	if err == nil {
+		t.Fatal("expected error for two entry points")
+	}
+	m = vm.NewObject()
+	if err := m.Merge(encode(t, ".text\nf:\nret\n"),
+		encode(t, ".entry g\n.text\ng:\nret\n")); err != nil {
+		t.Fatal(err)
+	}
+	if m.Entry != 1 {
+		t.Fatal("expected entry at 1, got", m.Entry)
+	}
+	if err := m.SetEntry("f"); err != nil || m.Entry != 0 {
+		t.Fatal("expected entry at f, got", m.Entry, err)
+	}
+}
+
+func TestEncodeRelocTypes(t *testing.T) {
+	o := encode(t, `.text
+main:
+lda $table+1
+mvi lo($f)
+mvi hi($f)
+mvi rel($table-2)
+ret
+f:
+ret
+.data
+table: .word $f, 0x1234
+b: .byte lo($ext), 7
+`)
+
+	expect := []struct {
+		sec    vm.SecType
+		typ    vm.RelocType
+		offset uint16
+		addend int16
+		name   string
+	}{
+		{vm.TEXT, vm.ABS16, 0x1, 1, "table"},
+		{vm.TEXT, vm.LO8, 0x4, 0, "f"},
+		{vm.TEXT, vm.HI8, 0x6, 0, "f"},
+		{vm.TEXT, vm.PC8, 0x8, -2, "table"},
+		{vm.DATA, vm.ABS16, 0x0, 0, "f"},
+		{vm.DATA, vm.LO8, 0x4, 0, "ext"},
+	}
+	if len(o.RelocTab) != len(expect) {
+		t.Fatal("expected", len(expect), "relocations, got", o.RelocTab)
+	}
+	for i, r := range o.RelocTab {
+		x := expect[i]
+		if r.Section() != x.sec || r.Type() != x.typ || r.Offset() != x.offset ||
+			r.Addend() != x.addend || o.SymTab[r.Index()].Name() != x.name {
+			t.Fatal("expected", x, "got", r)
+		}
+	}
+
+	// text at 0x1000 is followed by the data at 0x100c
+	m := vm.NewObject()
+	m.Layout.SetBase(vm.TEXT, 0x1000)
+	if err := m.Merge(o, encode(t, ".global ext\n.text\next:\nret\n")); err != nil {
+		t.Fatal(err)
+	}
+	text := []byte{byte(vm.LDA), 0x10, 0x0d, byte(vm.MVI), 0x0a, byte(vm.MVI),
+		0x10, byte(vm.MVI), 0x02, byte(vm.RET), byte(vm.RET), byte(vm.RET)}
+	if !bytes.Equal(m.SecTab[vm.TEXT], text) {
+		t.Fatal("expected", text, "got", m.SecTab[vm.TEXT])
+	}
+	data := []byte{0x10, 0x0a, 0x12, 0x34, 0x0b, 0x7}
+	if !bytes.Equal(m.SecTab[vm.DATA], data) {
+		t.Fatal("expected", data, "got", m.SecTab[vm.DATA])
+	}
+
+	// rel can reach 127 bytes forward, here from 0x1 to the end of the
+	// padding which follows the text at 0x3
+	for pad, ok := range map[int]bool{124: true, 125: false} {
+		m = vm.NewObject()
+		err := m.Merge(encode(t, ".text\nmain:\nmvi rel($x)\nret\n.data\n"+
+			"pad: .string \""+strings.Repeat("a", pad)+"\"\nx: .byte 1\n"))
+		if ok && err != nil {
+			t.Fatal(err)
+		}
+		if !ok && err == nil {
+			t.Fatal("expected relocation out of range error")
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package vm
+
+import (
+	"fmt"
+	"go/token"
+	"io"
+	"sort"
+)
+
+// Error is an error found while assembling, at a position in the source
+type Error struct {
+	Pos token.Position
+	Msg string
+}
+
+func (e Error) Error() string {
+	if e.Pos.IsValid() {
+		return e.Pos.String() + ": " + e.Msg
+	}
+	return e.Msg
+}
+
+// ErrorList is a list of errors which satisfies the error interface so
+// every problem found in a file can be reported at once
+type ErrorList []*Error
+
+// Add appends an error at pos to the list
+func (l *ErrorList) Add(pos token.Position, msg string) {
+	*l = append(*l, &Error{Pos: pos, Msg: msg})
+}
+
+func (l ErrorList) Len() int      { return len(l) }
+func (l ErrorList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+func (l ErrorList) Less(i, j int) bool {
+	a, b := &l[i].Pos, &l[j].Pos
+	if a.Filename != b.Filename {
+		return a.Filename < b.Filename
+	}
+	if a.Line != b.Line {
+		return a.Line < b.Line
+	}
+	if a.Column != b.Column {
+		return a.Column < b.Column
+	}
+	return l[i].Msg < l[j].Msg
+}
+
+// Sort orders the list by file, line, column and message
+func (l ErrorList) Sort() {
+	sort.Sort(l)
+}
+
+// RemoveMultiples sorts the list and keeps only the first error on each
+// line, since later ones are usually a consequence of the first
+func (l *ErrorList) RemoveMultiples() {
+	l.Sort()
+	var last token.Position
+	i := 0
+	for _, e := range *l {
+		if e.Pos.Filename != last.Filename || e.Pos.Line != last.Line ||
+			!e.Pos.IsValid() {
+			last = e.Pos
+			(*l)[i] = e
+			i++
+		}
+	}
+	*l = (*l)[:i]
+}
+
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", l[0], len(l)-1)
+}
+
+// Err returns the list as an error, or nil if the list is empty
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// PrintError writes each error in err to w, one per line, if err is an
+// ErrorList. Otherwise err is printed as is.
+func PrintError(w io.Writer, err error) {
+	if list, ok := err.(ErrorList); ok {
+		for _, e := range list {
+			fmt.Fprintln(w, e)
+		}
+	} else if err != nil {
+		fmt.Fprintln(w, err)
+	}
+}
@@ -0,0 +1,180 @@
+package vm
+
+// DropUnreachable removes the subroutines in the text section of a linked
+// object which can't be reached from the entry point. A subroutine is the
+// bytes labelled by a text symbol and it is reachable if a reachable
+// subroutine or the data section has a relocation referring to it, or if
+// reachable code before it can run on into it. Text not labelled by any
+// symbol is always kept, as are the data section and the symbols in it.
+//
+// The remaining text is moved down over the dropped subroutines, with the
+// symbols, relocations, line table and entry point updated to match. It
+// returns the symbols dropped and where each address in the original text
+// moved to, with the end of the text at moved[len(text)]. An error is
+// returned if a relocation no longer fits once the text has moved.
+func (o *Object) DropUnreachable() (dropped []Symbol, moved []uint16, err error) {
+	text := o.SecTab[TEXT]
+	n := len(text)
+
+	// each distinct range labelled by a symbol is a subroutine, with
+	// aliases sharing a range
+	type span struct{ addr, size uint16 }
+	spans := make(map[span]int)
+	var subs []span         // indexed by subroutine
+	owner := make([]int, n) // subroutine of each byte, -1 for none
+	for i := range owner {
+		owner[i] = -1
+	}
+	symSub := make([]int, len(o.SymTab))
+	for i, s := range o.SymTab {
+		symSub[i] = -1
+		if s.sec != TEXT || s.size == 0 || int(s.addr)+int(s.size) > n {
+			continue
+		}
+		k := span{s.addr, s.size}
+		id, ok := spans[k]
+		if !ok {
+			id = len(spans)
+			spans[k] = id
+			subs = append(subs, k)
+			for a := int(s.addr); a < int(s.addr+s.size); a++ {
+				owner[a] = id
+			}
+		}
+		symSub[i] = id
+	}
+
+	// walk the relocations and fall through from the entry point, any
+	// unlabelled text and the data
+	reached := make([]bool, len(spans))
+	var work []int
+	reach := func(id int) {
+		if id >= 0 && !reached[id] {
+			reached[id] = true
+			work = append(work, id)
+		}
+	}
+	calls := make(map[int][]int)
+	for _, r := range o.RelocTab {
+		if (r.sec == TEXT && int(r.offset) >= n) || int(r.index) >= len(symSub) {
+			continue
+		}
+		from, to := -1, symSub[r.index]
+		if r.sec == TEXT {
+			from = owner[r.offset]
+		}
+		if from < 0 {
+			reach(to)
+		} else {
+			calls[from] = append(calls[from], to)
+		}
+	}
+	if int(o.Entry) < n {
+		reach(owner[o.Entry])
+	}
+	for start := 0; start < n; {
+		end := start + 1
+		for end < n && owner[end] == owner[start] {
+			end++
+		}
+		if owner[start] < 0 && end < n && fallsThrough(text[start:end]) {
+			reach(owner[end])
+		}
+		start = end
+	}
+	for len(work) > 0 {
+		id := work[len(work)-1]
+		work = work[:len(work)-1]
+		if end := int(subs[id].addr + subs[id].size); end < n &&
+			fallsThrough(text[subs[id].addr:end]) {
+			reach(owner[end])
+		}
+		for _, to := range calls[id] {
+			reach(to)
+		}
+	}
+
+	keep := func(addr int) bool {
+		return owner[addr] < 0 || reached[owner[addr]]
+	}
+	moved = make([]uint16, n+1)
+	newText := make([]byte, 0, n)
+	for a := 0; a < n; a++ {
+		moved[a] = uint16(len(newText))
+		if keep(a) {
+			newText = append(newText, text[a])
+		}
+	}
+	moved[n] = uint16(len(newText))
+
+	// drop the symbols of unreached subroutines, renumbering the rest
+	idx := make([]byte, len(o.SymTab))
+	syms := make(SymbolTable, 0, len(o.SymTab))
+	for i, s := range o.SymTab {
+		if id := symSub[i]; id >= 0 && !reached[id] {
+			dropped = append(dropped, s)
+			continue
+		}
+		if s.sec == TEXT && int(s.addr) <= n {
+			s.addr = moved[s.addr]
+		}
+		idx[i] = byte(len(syms))
+		syms = append(syms, s)
+	}
+	relocs := make(RelocateTable, 0, len(o.RelocTab))
+	for _, r := range o.RelocTab {
+		if r.sec == TEXT && int(r.offset) < n {
+			if !keep(int(r.offset)) {
+				continue
+			}
+			r.offset = moved[r.offset]
+		}
+		if int(r.index) < len(idx) {
+			r.index = idx[r.index]
+		}
+		relocs = append(relocs, r)
+	}
+
+	lines := new(LineTable)
+	if o.LineTab == nil {
+		o.LineTab = lines
+	}
+	for _, l := range o.LineTab.Lines {
+		if int(l.Addr) < n && !keep(int(l.Addr)) {
+			l.Line = 0 // ends the range before the dropped subroutine
+		}
+		if int(l.Addr) <= n {
+			l.Addr = moved[l.Addr]
+		}
+		l.File = lines.file(o.LineTab.Files[l.File])
+		lines.Lines = append(lines.Lines, l)
+	}
+
+	if int(o.Entry) <= n {
+		o.Entry = moved[o.Entry]
+	}
+	o.SecTab[TEXT] = newText
+	o.SymTab = syms
+	o.RelocTab = relocs
+	o.LineTab = lines
+	return dropped, moved, o.doRelocations()
+}
+
+// fallsThrough reports whether execution can run off the end of code,
+// which it can unless the last instruction is an unconditional jmp, ret,
+// reti or hlt
+func fallsThrough(code []byte) bool {
+	il := Disassemble(code, 0, nil)
+	if len(il) == 0 {
+		return false
+	}
+	i := il[len(il)-1]
+	if i.Illegal {
+		return true
+	}
+	switch i.Op {
+	case JMP, RET, RETI, HLT:
+		return false
+	}
+	return true
+}
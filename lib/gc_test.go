@@ -0,0 +1,132 @@
+package vm_test
+
+import (
+	"bytes"
+	"testing"
+
+	vm "github.com/rthornton128/vm/lib"
+)
+
+func TestDropUnreachable(t *testing.T) {
+	o := vm.NewObject()
+	err := o.Merge(encode(t, `.text
+main:
+call $used
+lda $x
+ret
+dead:
+call $used
+ret
+used:
+ret
+.data
+x: .byte 1
+`), encode(t, ".text\nother:\nret\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dropped, moved, err := o.DropUnreachable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dropped) != 2 || dropped[0].Name() != "dead" ||
+		dropped[1].Name() != "other" {
+		t.Fatal("expected dead and other to be dropped, got", dropped)
+	}
+	if dropped[0].Len() != 4 {
+		t.Fatal("expected dead to be 4 bytes, got", dropped[0].Len())
+	}
+	if moved[11] != 7 || moved[12] != 8 {
+		t.Fatal("expected used to move to 7, got", moved)
+	}
+
+	// used moves down to 7 and x, following the text, to 8
+	expect := []byte{byte(vm.CALL), 0x0, 0x7, byte(vm.LDA), 0x0, 0x8,
+		byte(vm.RET), byte(vm.RET)}
+	if !bytes.Equal(o.SecTab[vm.TEXT], expect) {
+		t.Fatal("expected", expect, "got", o.SecTab[vm.TEXT])
+	}
+	for name, addr := range map[string]uint16{"main": 0, "used": 7} {
+		if s, ok := o.SymTab.Lookup(name); !ok || s.Address() != addr {
+			t.Fatal("expected", name, "at", addr, "got", s.Address(), ok)
+		}
+	}
+	for addr, line := range map[uint16]int{6: 5, 7: 10} {
+		if _, l, ok := o.LineTab.Lookup(addr); !ok || l != line {
+			t.Fatal("expected", addr, "at line", line, "got", l, ok)
+		}
+	}
+}
+
+func TestDropUnreachableData(t *testing.T) {
+	o := vm.NewObject()
+	err := o.Merge(encode(t, `.text
+main:
+ret
+dead:
+ret
+handler:
+ret
+.data
+vectors: .word $handler
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// handler is only referred to from the data, which is always kept
+	dropped, _, err := o.DropUnreachable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dropped) != 1 || dropped[0].Name() != "dead" {
+		t.Fatal("expected only dead to be dropped, got", dropped)
+	}
+	expect := []byte{0x0, 0x1}
+	if !bytes.Equal(o.SecTab[vm.DATA], expect) {
+		t.Fatal("expected handler at 1, got", o.SecTab[vm.DATA])
+	}
+}
+
+func TestDropUnreachableFallThrough(t *testing.T) {
+	o := vm.NewObject()
+	err := o.Merge(encode(t, `.text
+main:
+mvi 3
+mvr %b
+call $count
+ret
+count:
+cla
+loop:
+inc
+cmp %b
+jnz $loop
+done:
+ret
+spin:
+jmp $spin
+dead:
+ret
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// loop and done are only reached by running on from count, while dead
+	// follows a jmp
+	dropped, _, err := o.DropUnreachable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dropped) != 2 || dropped[0].Name() != "spin" ||
+		dropped[1].Name() != "dead" {
+		t.Fatal("expected spin and dead to be dropped, got", dropped)
+	}
+	for _, name := range []string{"count", "loop", "done"} {
+		if _, ok := o.SymTab.Lookup(name); !ok {
+			t.Fatal("expected", name, "to be kept")
+		}
+	}
+}
@@ -8,7 +8,7 @@ import (
 type Address uint16
 
 func (a Address) String() string {
-	return fmt.Sprintf("%x", a)
+	return fmt.Sprintf("%x", uint16(a))
 }
 
 type Opcode byte
@@ -46,6 +46,40 @@ const (
 	/* Logical */
 	AND
 	OR
+
+	/* Memory */
+	LDA  // load accumulator from address
+	STA  // store accumulator to address
+	LDAX // load accumulator from address in b:c
+	STAX // store accumulator to address in b:c
+
+	/* Arithmetic with carry */
+	ADC // add with carry
+	SBB // subtract with borrow
+	CMP // compare, subtract without storing the result
+
+	/* Conditional branching */
+	JC  // jump if carry
+	JNC // jump if not carry
+	JS  // jump if sign
+	JNS // jump if not sign
+	JV  // jump if overflow
+	JNV // jump if not overflow
+	JGT // jump if greater than (signed)
+	JGE // jump if greater than or equal (signed)
+	JLT // jump if less than (signed)
+	JLE // jump if less than or equal (signed)
+	JA  // jump if above (unsigned)
+	JBE // jump if below or equal (unsigned)
+
+	/* Interrupts */
+	EI   // enable interrupts
+	DI   // disable interrupts
+	RETI // return from interrupt
+	LIV  // load interrupt vector table address
+
+	/* Control */
+	HLT // halt, waiting for an interrupt if interrupts are enabled
 )
 
 var opcodes = map[Opcode]string{
@@ -71,12 +105,137 @@ var opcodes = map[Opcode]string{
 	SUB:  "sub",
 	AND:  "and",
 	OR:   "or",
+	LDA:  "lda",
+	STA:  "sta",
+	LDAX: "ldax",
+	STAX: "stax",
+	ADC:  "adc",
+	SBB:  "sbb",
+	CMP:  "cmp",
+	JC:   "jc",
+	JNC:  "jnc",
+	JS:   "js",
+	JNS:  "jns",
+	JV:   "jv",
+	JNV:  "jnv",
+	JGT:  "jgt",
+	JGE:  "jge",
+	JLT:  "jlt",
+	JLE:  "jle",
+	JA:   "ja",
+	JBE:  "jbe",
+	EI:   "ei",
+	DI:   "di",
+	RETI: "reti",
+	LIV:  "liv",
+	HLT:  "hlt",
 }
 
 func (o Opcode) String() string {
 	return opcodes[o]
 }
 
+// cycles is the number of clock cycles each instruction takes, modelled on
+// the 8080's states: four to fetch and decode an opcode plus three for each
+// additional memory access
+var cycles = map[Opcode]int{
+	NOP:  4,
+	JMP:  10,
+	JPZ:  10,
+	JNZ:  10,
+	CALL: 17,
+	RET:  10,
+	MOV:  5,
+	MVR:  5,
+	MVI:  7,
+	CLA:  4,
+	CLR:  4,
+	POP:  10,
+	PUSH: 11,
+	ADD:  4,
+	DIV:  16,
+	INC:  5,
+	MUL:  12,
+	SHL:  4,
+	SHR:  4,
+	SUB:  4,
+	AND:  4,
+	OR:   4,
+	LDA:  13,
+	STA:  13,
+	LDAX: 7,
+	STAX: 7,
+	ADC:  4,
+	SBB:  4,
+	CMP:  4,
+	JC:   10,
+	JNC:  10,
+	JS:   10,
+	JNS:  10,
+	JV:   10,
+	JNV:  10,
+	JGT:  10,
+	JGE:  10,
+	JLT:  10,
+	JLE:  10,
+	JA:   10,
+	JBE:  10,
+	EI:   4,
+	DI:   4,
+	RETI: 14,
+	LIV:  10,
+	HLT:  7,
+}
+
+// Cycles returns the number of clock cycles o takes to execute
+func (o Opcode) Cycles() int {
+	return cycles[o]
+}
+
+// IsJump reports whether o is a jump, conditional or otherwise, taking
+// an address operand
+func (o Opcode) IsJump() bool {
+	switch o {
+	case JMP, JPZ, JNZ, JC, JNC, JS, JNS, JV, JNV, JGT, JGE, JLT, JLE, JA, JBE:
+		return true
+	}
+	return false
+}
+
+// Valid reports whether o is a defined opcode
+func (o Opcode) Valid() bool {
+	_, ok := opcodes[o]
+	return ok
+}
+
+// ValidRegister reports whether o may be encoded with the register bits
+// reg. Only opcodes taking a register operand may set them.
+func (o Opcode) ValidRegister(reg Register) bool {
+	return reg == REGB || (o.HasRegister() && registers[reg] != "")
+}
+
+// HasRegister reports whether o takes a register operand, which is encoded
+// in the top bits of the opcode
+func (o Opcode) HasRegister() bool {
+	switch o {
+	case MOV, MVR, CLR, ADD, DIV, MUL, SHL, SHR, SUB, AND, OR, ADC, SBB, CMP:
+		return true
+	}
+	return false
+}
+
+// Operands returns the number of operand bytes which follow o in the text
+// section
+func (o Opcode) Operands() int {
+	switch {
+	case o.IsJump(), o == CALL, o == LDA, o == STA, o == LIV:
+		return 2
+	case o == MVI:
+		return 1
+	}
+	return 0
+}
+
 func LookupOpcode(s string) (Opcode, error) {
 	for k, v := range opcodes {
 		if s == v {
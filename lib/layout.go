@@ -0,0 +1,111 @@
+package vm
+
+import "fmt"
+
+// Bases gives the address each section is loaded at
+type Bases interface {
+	Base(sec SecType) uint16
+}
+
+// Layout places the sections of a program and its stack in memory. Any
+// address not set follows the default layout: the text at 0, the data
+// immediately after the text and the stack after whichever section ends
+// last. A stack without a size may grow up to the devices.
+type Layout struct {
+	addr      [section_max]uint16
+	set       [section_max]bool
+	stack     uint16
+	stackSet  bool
+	stackSize uint16
+}
+
+// SetBase sets the address sec is loaded at
+func (l *Layout) SetBase(sec SecType, addr uint16) {
+	l.addr[sec], l.set[sec] = addr, true
+}
+
+// SetStack sets the first address of the stack and the most it may grow,
+// or 0 for no limit other than the devices
+func (l *Layout) SetStack(addr, size uint16) {
+	l.stack, l.stackSet, l.stackSize = addr, true, size
+}
+
+// SetStackSize limits the stack to size bytes, wherever it is
+func (l *Layout) SetStackSize(size uint16) {
+	l.stackSize = size
+}
+
+// base returns the address sec is loaded at, given the sections in st
+func (l *Layout) base(st SectionTable, sec SecType) uint16 {
+	switch {
+	case l.set[sec]:
+		return l.addr[sec]
+	case sec == DATA:
+		return l.base(st, TEXT) + uint16(len(st[TEXT]))
+	}
+	return 0
+}
+
+// stackBase returns the first address of the stack, given the sections in
+// st
+func (l *Layout) stackBase(st SectionTable) uint16 {
+	if l.stackSet {
+		return l.stack
+	}
+	var end uint16
+	for sec := range st {
+		if e := l.base(st, SecType(sec)) + uint16(len(st[sec])); e > end {
+			end = e
+		}
+	}
+	return end
+}
+
+// DeviceBase is the lowest address of the devices the vm command maps by
+// default. Programs are laid out below it.
+const DeviceBase = 0xff00
+
+// check returns an error if the sections and stack overlap each other or
+// the default devices, or don't fit in the address space
+func (l *Layout) check(st SectionTable) error {
+	type region struct {
+		name       string
+		start, end int
+	}
+	regions := []region{{"devices", DeviceBase, 0x10000}}
+	for sec := range st {
+		if len(st[sec]) > 0 {
+			b := int(l.base(st, SecType(sec)))
+			regions = append(regions,
+				region{SecType(sec).String(), b, b + len(st[sec])})
+		}
+	}
+	// the stack always holds the return address of the entry point
+	sb, size := int(l.stackBase(st)), int(l.stackSize)
+	if size < 2 {
+		size = 2
+	}
+	regions = append(regions, region{"stack", sb, sb + size})
+	for i, r := range regions {
+		if r.end > 0x10000 {
+			return fmt.Errorf("%s at %04x does not fit in memory", r.name, r.start)
+		}
+		for _, o := range regions[:i] {
+			if r.start < o.end && o.start < r.end {
+				return fmt.Errorf("%s at %04x overlaps %s at %04x", r.name,
+					r.start, o.name, o.start)
+			}
+		}
+	}
+	return nil
+}
+
+// fix sets every address to where it resolves to for st, so the layout no
+// longer depends on the size of the sections
+func (l *Layout) fix(st SectionTable) {
+	sb := l.stackBase(st)
+	for sec := range l.addr {
+		l.SetBase(SecType(sec), l.base(st, SecType(sec)))
+	}
+	l.stack, l.stackSet = sb, true
+}
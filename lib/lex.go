@@ -7,4 +7,9 @@ var symbols = map[string]lex.Token{
 	".": DOT,
 	":": COLON,
 	"$": DOLLAR,
+	",": COMMA,
+	"(": LPAREN,
+	")": RPAREN,
+	"+": PLUS,
+	"-": MINUS,
 }
@@ -0,0 +1,164 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// LineTable maps addresses in the text section back to the source lines
+// they were assembled from. Each entry covers the addresses from its own up
+// to the next entry's. An entry with line 0 ends a range without starting
+// another, such as at the end of an object's text.
+type LineTable struct {
+	Files []string
+	Lines []Line // sorted by address
+}
+
+// Line is the first address of a range of instructions assembled from a
+// line of the file at index File in the table's files
+type Line struct {
+	Addr uint16
+	File byte
+	Line uint16
+}
+
+// ScanLineTable reads a line table: the number of files, each file name
+// preceded by its length and then the entries as address, file and line
+func ScanLineTable(b []byte) (*LineTable, error) {
+	lt := new(LineTable)
+	if len(b) == 0 {
+		return lt, nil
+	}
+	nfiles, i := int(b[0]), 1
+	for ; nfiles > 0; nfiles-- {
+		if i >= len(b) || i+1+int(b[i]) > len(b) {
+			return nil, errors.New("line table: truncated file name")
+		}
+		lt.Files = append(lt.Files, string(b[i+1:i+1+int(b[i])]))
+		i += 1 + int(b[i])
+	}
+	if (len(b)-i)%5 != 0 {
+		return nil, errors.New("line table: truncated entry")
+	}
+	for ; i < len(b); i += 5 {
+		l := Line{Addr: toAddress(b[i : i+2]), File: b[i+2],
+			Line: toAddress(b[i+3 : i+5])}
+		if int(l.File) >= len(lt.Files) {
+			return nil, fmt.Errorf("line table: invalid file index %d", l.File)
+		}
+		lt.Lines = append(lt.Lines, l)
+	}
+	return lt, nil
+}
+
+func (lt *LineTable) Bytes() []byte {
+	if lt == nil || len(lt.Lines) == 0 {
+		return []byte{}
+	}
+	b := []byte{byte(len(lt.Files))}
+	for _, f := range lt.Files {
+		b = append(b, byte(len(f)))
+		b = append(b, f...)
+	}
+	for _, l := range lt.Lines {
+		b = append(b, toBytes(l.Addr)...)
+		b = append(b, l.File)
+		b = append(b, toBytes(l.Line)...)
+	}
+	return b
+}
+
+func (lt *LineTable) Size() uint16 {
+	return uint16(len(lt.Bytes()))
+}
+
+// file returns the index of name in the files, adding it if needed
+func (lt *LineTable) file(name string) byte {
+	for i, f := range lt.Files {
+		if f == name {
+			return byte(i)
+		}
+	}
+	lt.Files = append(lt.Files, name)
+	return byte(len(lt.Files) - 1)
+}
+
+// Add records that the instructions from addr onward were assembled from
+// line of file. Addresses must be added in increasing order and an entry
+// is only added when the file or line changes.
+func (lt *LineTable) Add(addr uint16, file string, line int) {
+	f := lt.file(file)
+	if n := len(lt.Lines); n > 0 {
+		last := lt.Lines[n-1]
+		if last.File == f && int(last.Line) == line {
+			return
+		}
+		if last.Addr == addr {
+			lt.Lines = lt.Lines[:n-1]
+		}
+	}
+	lt.Lines = append(lt.Lines, Line{Addr: addr, File: f, Line: uint16(line)})
+}
+
+// End ends the last range at addr
+func (lt *LineTable) End(addr uint16) {
+	if n := len(lt.Lines); n > 0 && lt.Lines[n-1].Line != 0 {
+		lt.Lines = append(lt.Lines, Line{Addr: addr, File: lt.Lines[n-1].File})
+	}
+}
+
+// Lookup returns the file and line the instruction at addr was assembled
+// from
+func (lt *LineTable) Lookup(addr uint16) (string, int, bool) {
+	if lt == nil {
+		return "", 0, false
+	}
+	i := sort.Search(len(lt.Lines), func(i int) bool {
+		return lt.Lines[i].Addr > addr
+	})
+	if i == 0 || lt.Lines[i-1].Line == 0 {
+		return "", 0, false
+	}
+	l := lt.Lines[i-1]
+	return lt.Files[l.File], int(l.Line), true
+}
+
+// Position returns addr's source position in the form file:line, or an
+// empty string if it has none
+func (lt *LineTable) Position(addr uint16) string {
+	if file, line, ok := lt.Lookup(addr); ok {
+		return fmt.Sprintf("%s:%d", file, line)
+	}
+	return ""
+}
+
+// merge appends the lines of other, whose addresses have already been
+// moved to follow those of lt
+func (lt *LineTable) merge(other *LineTable) {
+	if other == nil {
+		return
+	}
+	for _, l := range other.Lines {
+		l.File = lt.file(other.Files[l.File])
+		lt.Lines = append(lt.Lines, l)
+	}
+}
+
+// Relocated returns a copy of the table with every entry moved by addend
+func (lt *LineTable) Relocated(addend uint16) *LineTable {
+	c := new(LineTable)
+	c.merge(lt)
+	c.offset(addend)
+	return c
+}
+
+// offset moves every entry by addend
+func (lt *LineTable) offset(addend uint16) {
+	if lt == nil {
+		return
+	}
+	for i := range lt.Lines {
+		lt.Lines[i].Addr += addend
+	}
+}
@@ -0,0 +1,99 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/token"
+	"io"
+	"strings"
+)
+
+// listItem is the bytes emitted for the source at pos, at an address
+// relative to the start of its section
+type listItem struct {
+	pos   token.Pos
+	sec   SecType
+	addr  uint16
+	b     []byte
+	reloc map[int]bool // offsets within b of bytes the linker fills in
+}
+
+// listBytes is the number of bytes shown on each line of a listing
+const listBytes = 4
+
+// listed records b, assembled at addr, for the listing. Relocations from
+// nrel on in the relocation table are those added while assembling b.
+func (e *Encoder) listed(pos token.Pos, sec SecType, addr int, b []byte, nrel int) {
+	reloc := make(map[int]bool)
+	for _, r := range e.ob.RelocTab[nrel:] {
+		for i := 0; i < r.Type().Size(); i++ {
+			reloc[int(r.Offset())-addr+i] = true
+		}
+	}
+	e.list = append(e.list, listItem{pos: pos, sec: sec, addr: uint16(addr),
+		b: append([]byte{}, b...), reloc: reloc})
+}
+
+// Listing writes a listing of src, which must be the source most recently
+// encoded. Each source line is shown with the section address and bytes
+// assembled from it, with R marking operands the linker relocates, followed
+// by the symbol table.
+func (e *Encoder) Listing(w io.Writer, src []byte) error {
+	items := make(map[int][]listItem)
+	for _, it := range e.list {
+		line := e.f.Position(it.pos).Line
+		items[line] = append(items[line], it)
+	}
+
+	bw := bufio.NewWriter(w)
+	row := func(format string, args ...interface{}) {
+		bw.WriteString(strings.TrimRight(fmt.Sprintf(format, args...), " "))
+		bw.WriteByte('\n')
+	}
+	fmt.Fprintf(bw, "%s\n\n", e.f.Name())
+	row("%5s %-9s %-14s %s", "line", "address", "bytes", "source")
+	s := bufio.NewScanner(bytes.NewReader(src))
+	for n := 1; s.Scan(); n++ {
+		text := strings.TrimRight(s.Text(), " \t\r")
+		list := items[n]
+		if len(list) == 0 {
+			row("%5d %-9s %-14s %s", n, "", "", text)
+			continue
+		}
+		for i, it := range list {
+			for off := 0; off == 0 || off < len(it.b); off += listBytes {
+				end := off + listBytes
+				if end > len(it.b) {
+					end = len(it.b)
+				}
+				var hex []string
+				reloc := false
+				for j, b := range it.b[off:end] {
+					hex = append(hex, fmt.Sprintf("%02x", b))
+					reloc = reloc || it.reloc[off+j]
+				}
+				raw := strings.Join(hex, " ")
+				if reloc {
+					raw += " R"
+				}
+				addr := fmt.Sprintf("%s:%04x", it.sec, int(it.addr)+off)
+				if i == 0 && off == 0 {
+					row("%5d %-9s %-14s %s", n, addr, raw, text)
+				} else {
+					row("%5s %-9s %s", "", addr, raw)
+				}
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(bw, "\nSymbols:\n")
+	for _, sym := range e.ob.SymTab {
+		fmt.Fprintf(bw, "  %04x %-5s %-6s %s\n", sym.addr, sym.sec, sym.bind,
+			sym.name)
+	}
+	return bw.Flush()
+}
@@ -9,17 +9,28 @@ import (
 // TODO use shorter magic number
 var MagicNumber = []byte{0xd, 0xe, 0xa, 0xd, 0xb, 0xe, 0xe, 0xf}
 
+// object header flags
+const (
+	flagEntry      = 1 << iota // the object sets the entry point
+	flagRelocTypes             // relocations have a section, type and addend
+)
+
 type Object struct {
 	Entry    uint16
+	HasEntry bool // Entry is set, since 0 is a valid entry point
 	RelAddr  uint16
 	RelSize  uint16
 	SecAddr  uint16
 	SecSize  uint16
 	SymAddr  uint16
 	SymSize  uint16
+	LineAddr uint16
+	LineSize uint16
 	SecTab   SectionTable
 	RelocTab RelocateTable
 	SymTab   SymbolTable
+	LineTab  *LineTable
+	Layout   Layout // where the linked sections are loaded
 }
 
 func NewObject() *Object {
@@ -27,13 +38,14 @@ func NewObject() *Object {
 		SecTab:   make(SectionTable, section_max),
 		RelocTab: make(RelocateTable, 0),
 		SymTab:   make(SymbolTable, 0),
+		LineTab:  new(LineTable),
 	}
 }
 
 func ScanObject(b []byte) (*Object, error) {
 	o := NewObject()
 
-	if len(b) < 21 {
+	if len(b) < 22 {
 		return o, errors.New("not enough bytes")
 	}
 
@@ -52,9 +64,65 @@ func ScanObject(b []byte) (*Object, error) {
 	o.SecAddr = toAddress(b[18:20])
 	o.SecSize = toAddress(b[20:22])
 
-	o.ScanRelocateTable(b[o.RelAddr : o.RelAddr+o.RelSize])
-	o.ScanSymbolTable(b[o.SymAddr : o.SymAddr+o.SymSize])
-	o.ScanSectionTable(b[o.SecAddr : o.SecAddr+o.SecSize])
+	// the relocation table follows the header, so its address is the length
+	// of the header
+	if int(o.RelAddr) > len(b) {
+		return o, errors.New("not enough bytes")
+	}
+
+	// objects written before the header had flags set an entry point by
+	// having a main label in the text
+	if o.RelAddr >= uint16(len(MagicNumber))+19 {
+		o.HasEntry = b[26]&flagEntry != 0
+	}
+
+	// objects written before the line table was added have their tables
+	// straight after the section table address and size
+	if o.RelAddr >= uint16(len(MagicNumber))+18 {
+		o.LineAddr = toAddress(b[22:24])
+		o.LineSize = toAddress(b[24:26])
+	}
+
+	// the section table's size doesn't include its count of sections
+	for _, t := range []struct {
+		name       string
+		addr, size uint16
+	}{
+		{"relocation", o.RelAddr, o.RelSize},
+		{"symbol", o.SymAddr, o.SymSize},
+		{"section", o.SecAddr, o.SecSize + 1},
+		{"line", o.LineAddr, o.LineSize},
+	} {
+		if int(t.addr)+int(t.size) > len(b) {
+			return o, fmt.Errorf("invalid %s table", t.name)
+		}
+	}
+
+	// objects written before relocations had types only relocate 16-bit
+	// addresses in the text
+	if o.RelAddr >= uint16(len(MagicNumber))+19 && b[26]&flagRelocTypes != 0 {
+		o.ScanRelocateTable(b[o.RelAddr : o.RelAddr+o.RelSize])
+	} else {
+		o.scanRelocateTable(b[o.RelAddr:o.RelAddr+o.RelSize], 3)
+	}
+	if err := o.ScanSymbolTable(b[o.SymAddr : o.SymAddr+o.SymSize]); err != nil {
+		return o, err
+	}
+	if err := o.ScanSectionTable(b[o.SecAddr : o.SecAddr+o.SecSize+1]); err != nil {
+		return o, err
+	}
+
+	lt, err := ScanLineTable(b[o.LineAddr : o.LineAddr+o.LineSize])
+	if err != nil {
+		return o, err
+	}
+	o.LineTab = lt
+
+	if o.RelAddr < uint16(len(MagicNumber))+19 {
+		if s, ok := o.SymTab.Lookup("main"); ok && s.sec == TEXT {
+			o.HasEntry = true
+		}
+	}
 
 	return o, nil
 }
@@ -68,7 +136,7 @@ func (o *Object) Bytes() []byte {
 	// entry point
 	b = append(b, toBytes(o.Entry)...)
 
-	i := uint16(len(MagicNumber)) + 14
+	i := uint16(len(MagicNumber)) + 19
 
 	// relocation table size and addr
 	b = append(b, toBytes(i)...)
@@ -83,18 +151,30 @@ func (o *Object) Bytes() []byte {
 	// section table size and addr
 	b = append(b, toBytes(i)...)
 	b = append(b, toBytes(o.SecTab.Size())...)
-	i += o.SecTab.Size()
+	i += o.SecTab.Size() + 1
+
+	// line table size and addr
+	b = append(b, toBytes(i)...)
+	b = append(b, toBytes(o.LineTab.Size())...)
+
+	flags := byte(flagRelocTypes)
+	if o.HasEntry {
+		flags |= flagEntry
+	}
+	b = append(b, flags)
 
 	// tables
 	b = append(b, o.RelocTab.Bytes()...)
 	b = append(b, o.SymTab.Bytes()...)
 	b = append(b, o.SecTab.Bytes()...)
+	b = append(b, o.LineTab.Bytes()...)
 
 	return b
 }
 
 func (o *Object) Merge(objs ...*Object) error {
 	for _, ob := range objs {
+		ob.SymTab.setSizes(ob.SecTab)
 		if err := o.MergeSections(ob); err != nil {
 			return err
 		}
@@ -107,36 +187,78 @@ func (o *Object) Merge(objs ...*Object) error {
 			return err
 		}
 
-		if o.Entry == 0 && ob.Entry != 0 {
-			o.Entry = ob.Entry
+		o.LineTab.merge(ob.LineTab)
+
+		if ob.HasEntry {
+			if o.HasEntry {
+				return errors.New("entry point set by more than one object")
+			}
+			o.Entry, o.HasEntry = ob.Entry, true
 		}
 	}
-	o.doRelocations()
 
-	return nil
+	return o.doRelocations()
 }
 
+// Program is a linked program ready to be loaded. It may carry the symbol
+// and line tables of the objects it was linked from, so addresses can be
+// named when it is run or debugged, unless it was stripped.
 type Program struct {
-	Entry   uint16
-	SecOff  uint16
-	SecSize uint16
-	SecTab  SectionTable
+	Entry    uint16
+	SecOff   uint16
+	SecSize  uint16
+	SymOff   uint16
+	SymSize  uint16
+	LineOff  uint16
+	LineSize uint16
+	SecTab   SectionTable
+	SymTab   SymbolTable
+	LineTab  *LineTable
+	Layout   Layout
 }
 
+// programHeader is the size of the header following the magic number
+const programHeader = 0x16
+
+// NewProgram returns the program for a linked object, including its
+// defined symbols and line table
 func NewProgram(o *Object) *Program {
 	p := Program{
-		Entry:   o.Entry,
-		SecOff:  0x6,
-		SecSize: o.SecTab.Size(),
+		Entry:   o.Base(TEXT) + o.Entry,
 		SecTab:  make(SectionTable, section_max),
+		SymTab:  make(SymbolTable, 0),
+		LineTab: new(LineTable),
 	}
 	for i := range p.SecTab {
 		p.SecTab[i] = make([]byte, len(o.SecTab[i]))
 		copy(p.SecTab[i], o.SecTab[i])
 	}
+	for _, s := range o.SymTab {
+		if s.sec != UNDEF {
+			p.SymTab = append(p.SymTab, s)
+		}
+	}
+	p.LineTab.merge(o.LineTab)
+	p.Layout = o.Layout
+	p.Layout.fix(p.SecTab)
+	p.layout()
 	return &p
 }
 
+// layout sets the offsets and sizes of the tables, which follow the header
+// in the order sections, symbols, lines
+func (p *Program) layout() {
+	p.SecOff = programHeader
+	p.SecSize = p.SecTab.Size()
+	p.SymOff = p.SecOff + p.SecSize + 1
+	p.SymSize = p.SymTab.Size()
+	p.LineOff = p.SymOff + p.SymSize
+	p.LineSize = p.LineTab.Size()
+}
+
+// ScanProgram reads a program. Programs written before the symbol and line
+// tables and the layout were added have a shorter header, marked by the
+// section table offset, and are read without them.
 func ScanProgram(b []byte) (*Program, error) {
 	if len(b) < 14 {
 		return nil, fmt.Errorf("invalid length")
@@ -145,50 +267,128 @@ func ScanProgram(b []byte) (*Program, error) {
 		return nil, fmt.Errorf("invalid virtual machine object")
 	}
 	b = b[len(MagicNumber):]
-	//fmt.Println("bytes:", b)
 	p := Program{
 		Entry:   toAddress(b[:2]),
 		SecOff:  toAddress(b[2:4]),
 		SecSize: toAddress(b[4:6]),
 		SecTab:  make(SectionTable, section_max),
+		SymTab:  make(SymbolTable, 0),
+		LineTab: new(LineTable),
+	}
+	if int(p.SecOff) >= len(b) {
+		return nil, fmt.Errorf("invalid section table offset")
+	}
+	if p.SecOff >= 0xa {
+		p.SymOff = toAddress(b[6:8])
+		p.SymSize = toAddress(b[8:10])
+		if int(p.SymOff)+int(p.SymSize) > len(b) {
+			return nil, fmt.Errorf("invalid symbol table")
+		}
+		if err := p.SymTab.scan(b[p.SymOff : p.SymOff+p.SymSize]); err != nil {
+			return nil, err
+		}
+	}
+	if p.SecOff >= 0xe {
+		p.LineOff = toAddress(b[10:12])
+		p.LineSize = toAddress(b[12:14])
+		if int(p.LineOff)+int(p.LineSize) > len(b) {
+			return nil, fmt.Errorf("invalid line table")
+		}
+		lt, err := ScanLineTable(b[p.LineOff : p.LineOff+p.LineSize])
+		if err != nil {
+			return nil, err
+		}
+		p.LineTab = lt
+	}
+	if p.SecOff >= programHeader {
+		p.Layout.SetBase(TEXT, toAddress(b[14:16]))
+		p.Layout.SetBase(DATA, toAddress(b[16:18]))
+		p.Layout.SetStack(toAddress(b[18:20]), toAddress(b[20:22]))
 	}
-	//fmt.Println("entry:", p.Entry,
-	//	", secoff:", p.SecOff,
-	//	", secsize:", p.SecSize)
 
-	nsec := uint16(b[p.SecOff])
-	j := p.SecOff + 1
-	for i := uint16(0); i < nsec; i++ {
-		secType := b[j]
-		//secOff := toAddress(b[j+1 : j+3])
-		secLen := toAddress(b[j+3 : j+5])
+	// section offsets are relative to the start of the section table
+	st := b[p.SecOff:]
+	nsec := uint16(st[0])
+	for i, j := uint16(0), 1; i < nsec; i++ {
+		secType := st[j]
+		secOff := toAddress(st[j+1 : j+3])
+		secLen := toAddress(st[j+3 : j+5])
 		j += 5
-		//fmt.Println("type, addr, len", secType, secOff, secLen)
 		p.SecTab[secType] = make([]byte, secLen)
-		copy(p.SecTab[secType], b[j:j+secLen])
-		j += secLen
+		copy(p.SecTab[secType], st[secOff:secOff+secLen])
 	}
 	return &p, nil
 }
 
 func (p *Program) Bytes() []byte {
-	b := make([]byte, uint16(len(MagicNumber))+7+p.SecTab.Size())
-	//fmt.Println("bytes len:", len(b))
+	p.layout()
 	x := len(MagicNumber)
-	copy(b[:x], MagicNumber)
-	copy(b[x:x+2], toBytes(p.Entry))
-	copy(b[x+2:x+4], toBytes(p.SecOff))
-	copy(b[x+4:x+6], toBytes(p.SecSize))
-	copy(b[x+6:], p.SecTab.Bytes())
+	b := make([]byte, 0, x+int(p.LineOff+p.LineSize))
+	b = append(b, MagicNumber...)
+	sb, size := p.Stack()
+	for _, v := range []uint16{p.Entry, p.SecOff, p.SecSize, p.SymOff,
+		p.SymSize, p.LineOff, p.LineSize, p.Base(TEXT), p.Base(DATA), sb,
+		size} {
+		b = append(b, toBytes(v)...)
+	}
+	b = append(b, p.SecTab.Bytes()...)
+	b = append(b, p.SymTab.Bytes()...)
+	b = append(b, p.LineTab.Bytes()...)
 	return b
 }
 
+// Strip removes the symbol and line tables from the program
+func (p *Program) Strip() {
+	p.SymTab = make(SymbolTable, 0)
+	p.LineTab = new(LineTable)
+	p.layout()
+}
+
+// HasSymbols reports whether the program carries a symbol table
+func (p *Program) HasSymbols() bool {
+	return len(p.SymTab) > 0
+}
+
+// AddressMap returns a map of the program's symbols at their absolute
+// addresses, which is empty if the program has no symbols
+func (p *Program) AddressMap() *AddressMap {
+	// symbol sizes aren't stored in the program
+	st := append(SymbolTable{}, p.SymTab...)
+	st.setSizes(p.SecTab)
+	return NewAddressMap(st, p)
+}
+
+// Base returns the address a section is loaded at
+func (p *Program) Base(sec SecType) uint16 {
+	return p.Layout.base(p.SecTab, sec)
+}
+
+// Stack returns the first address of the stack and the most it may grow,
+// which is 0 if it may grow up to the devices
+func (p *Program) Stack() (uint16, uint16) {
+	return p.Layout.stackBase(p.SecTab), p.Layout.stackSize
+}
+
+// Lookup returns the symbol nearest at or before addr and the offset of
+// addr from it
+func (p *Program) Lookup(addr uint16) (string, uint16, bool) {
+	return p.AddressMap().Lookup(addr)
+}
+
+// Lines returns the program's line table with addresses at which the text
+// is loaded
+func (p *Program) Lines() *LineTable {
+	return p.LineTab.Relocated(p.Base(TEXT))
+}
+
 type SecType byte
 
 const (
 	TEXT SecType = iota
 	DATA
 	section_max
+
+	UNDEF SecType = 0xff // symbol referred to but defined in another object
 )
 
 var sections = []string{
@@ -196,6 +396,16 @@ var sections = []string{
 	TEXT: "text",
 }
 
+func (s SecType) String() string {
+	if s == UNDEF {
+		return "undef"
+	}
+	if int(s) < len(sections) {
+		return sections[s]
+	}
+	return fmt.Sprintf("section(%d)", byte(s))
+}
+
 func LookupSectionName(name string) (byte, error) {
 	for i, s := range sections {
 		if name == s {
@@ -211,18 +421,29 @@ func LookupSectionName(name string) (byte, error) {
 type SectionTable [][]byte
 
 func (o *Object) ScanSectionTable(b []byte) error {
+	if len(b) == 0 {
+		return errors.New("invalid section table")
+	}
 	// section table starts with the number of sections that should be scanned
 	nsec := int(b[0])
 
 	// it then contains a table with format: type, address, length
 	for i, j := 0, 1; i < nsec; i++ {
-		//fmt.Println(i, j)
+		if j+5 > len(b) {
+			return errors.New("invalid section table")
+		}
 		t := b[j]
+		if int(t) >= len(o.SecTab) {
+			return fmt.Errorf("invalid section: %d", t)
+		}
 		if cap(o.SecTab[t]) > 0 {
-			return fmt.Errorf("duplicate section:", sections[t])
+			return fmt.Errorf("duplicate section: %s", SecType(t))
 		}
 		addr := toAddress(b[j+1 : j+3])
 		ln := toAddress(b[j+3 : j+5])
+		if int(addr)+int(ln) > len(b) {
+			return fmt.Errorf("invalid section: %s", SecType(t))
+		}
 
 		o.SecTab[t] = make([]byte, ln)
 		copy(o.SecTab[t], b[addr:addr+ln])
@@ -278,9 +499,10 @@ func (o *Object) MergeSections(other *Object) error {
 		if cap(o.SecTab[sec]) > 0 {
 			addend := uint16(len(o.SecTab[sec]))
 			other.updateSymbols(SecType(sec), addend)
+			other.updateRelocations(SecType(sec), addend)
 			if SecType(sec) == TEXT {
-				other.updateRelocations(addend)
-				if other.Entry != 0 {
+				other.LineTab.offset(addend)
+				if other.HasEntry {
 					other.Entry += addend
 				}
 			}
@@ -295,6 +517,26 @@ func (o *Object) MergeSections(other *Object) error {
 	return nil
 }
 
+// Base returns the address a section is loaded at in a linked object
+func (o *Object) Base(sec SecType) uint16 {
+	return o.Layout.base(o.SecTab, sec)
+}
+
+// CheckLayout returns an error if the linked sections and stack overlap or
+// don't fit in memory
+func (o *Object) CheckLayout() error {
+	return o.Layout.check(o.SecTab)
+}
+
+// Base returns the address a section is loaded at by default. The data
+// section immediately follows the text section.
+func (st SectionTable) Base(sec SecType) uint16 {
+	if sec == DATA {
+		return uint16(len(st[TEXT]))
+	}
+	return 0
+}
+
 func (st SectionTable) Size() uint16 {
 	sz := 0
 	for _, v := range st {
@@ -305,28 +547,128 @@ func (st SectionTable) Size() uint16 {
 	return uint16(sz)
 }
 
-// Relocate holds the offset of an address within the text section of an
-// object. It also contains an index into the symbol table. A relocate
-// object is used by the linker to adjust the location of symbols in
-// memory
+// RelocType is the part of a symbol's address, plus an addend, which a
+// relocation fills in
+type RelocType byte
+
+const (
+	ABS16 RelocType = iota // the 16-bit address, most significant byte first
+	LO8                    // the least significant byte of the address
+	HI8                    // the most significant byte of the address
+	PC8                    // signed 8-bit distance from the relocated byte
+)
+
+var relocTypes = []string{
+	ABS16: "abs16",
+	LO8:   "lo8",
+	HI8:   "hi8",
+	PC8:   "pc8",
+}
+
+func (t RelocType) String() string {
+	if int(t) < len(relocTypes) {
+		return relocTypes[t]
+	}
+	return fmt.Sprintf("reloc(%d)", byte(t))
+}
+
+// Size returns the number of bytes the relocation fills in
+func (t RelocType) Size() int {
+	if t == ABS16 {
+		return 2
+	}
+	return 1
+}
+
+// Relocate holds the offset of an address within a section of an object,
+// the index of the symbol in the symbol table it refers to, its type and an
+// addend. A relocate object is used by the linker to adjust the location of
+// symbols in memory.
 // RelocateTable is a list of relocatable objects
 type RelocateTable []RelocAddr
 
 type RelocAddr struct {
 	index  byte
 	offset uint16
+	sec    SecType
+	typ    RelocType
+	addend int16
+}
+
+// relocSize is the encoded size of a relocation. Objects without the
+// flagRelocTypes header flag have 3 byte relocations holding only the index
+// and offset of a 16-bit address in the text section.
+const relocSize = 7
+
+// Index returns the index of the symbol in the symbol table
+func (r RelocAddr) Index() byte {
+	return r.index
+}
+
+// Offset returns the offset within the section to be relocated
+func (r RelocAddr) Offset() uint16 {
+	return r.offset
+}
+
+// Section returns the section to be relocated
+func (r RelocAddr) Section() SecType {
+	return r.sec
+}
+
+// Type returns the part of the address the relocation fills in
+func (r RelocAddr) Type() RelocType {
+	return r.typ
+}
+
+// Addend returns the value added to the symbol's address
+func (r RelocAddr) Addend() int16 {
+	return r.addend
+}
+
+// Ref returns the relocation in assembly syntax, given the name of its
+// symbol, such as $table+2 or lo($table)
+func (r RelocAddr) Ref(name string) string {
+	ref := "$" + name
+	if r.addend != 0 {
+		ref += fmt.Sprintf("%+d", r.addend)
+	}
+	switch r.typ {
+	case LO8:
+		return "lo(" + ref + ")"
+	case HI8:
+		return "hi(" + ref + ")"
+	case PC8:
+		return "rel(" + ref + ")"
+	}
+	return ref
 }
 
 func (o *Object) ScanRelocateTable(b []byte) {
-	for i := 0; i < len(b); i += 3 {
-		o.RelocTab = append(o.RelocTab,
-			RelocAddr{index: b[i], offset: toAddress(b[i+1 : i+3])})
+	o.scanRelocateTable(b, relocSize)
+}
+
+func (o *Object) scanRelocateTable(b []byte, size int) {
+	for i := 0; i+size <= len(b); i += size {
+		r := RelocAddr{index: b[i], offset: toAddress(b[i+1 : i+3])}
+		if size == relocSize {
+			r.sec, r.typ = SecType(b[i+3]), RelocType(b[i+4])
+			r.addend = int16(toAddress(b[i+5 : i+7]))
+		}
+		o.RelocTab = append(o.RelocTab, r)
 	}
-	return
 }
 
+// AddRelocate adds a relocation of the 16-bit address at offset in the
+// text section
 func (o *Object) AddRelocate(index byte, offset uint16) {
-	o.RelocTab = append(o.RelocTab, RelocAddr{index, offset})
+	o.AddRelocateType(TEXT, ABS16, index, offset, 0)
+}
+
+// AddRelocateType adds a relocation of the given type at offset in sec
+func (o *Object) AddRelocateType(sec SecType, typ RelocType, index byte,
+	offset uint16, addend int16) {
+	o.RelocTab = append(o.RelocTab, RelocAddr{index: index, offset: offset,
+		sec: sec, typ: typ, addend: addend})
 }
 
 func (rt RelocateTable) Bytes() []byte {
@@ -334,20 +676,48 @@ func (rt RelocateTable) Bytes() []byte {
 	for _, r := range rt {
 		b = append(b, r.index)
 		b = append(b, toBytes(r.offset)...)
+		b = append(b, byte(r.sec), byte(r.typ))
+		b = append(b, toBytes(uint16(r.addend))...)
 	}
 	return b
 }
 
-func (o *Object) doRelocations() {
-	for i, sym := range o.SymTab {
-		for _, r := range o.RelocTab {
-			if r.index == byte(i) {
-				//fmt.Println("before:", o.SecTab[TEXT][r.offset:r.offset+2])
-				copy(o.SecTab[TEXT][r.offset:r.offset+2], toBytes(sym.addr))
-				//fmt.Println("after:", o.SecTab[TEXT][r.offset:r.offset+2])
-			}
+// doRelocations fills in the part of each symbol's address, plus the
+// addend, that each relocation refers to. It returns an error if a value
+// doesn't fit in the bytes it's written to.
+func (o *Object) doRelocations() error {
+	for _, r := range o.RelocTab {
+		if int(r.index) >= len(o.SymTab) || o.SymTab[r.index].sec == UNDEF {
+			continue
+		}
+		sym := o.SymTab[r.index]
+		if int(r.sec) >= len(o.SecTab) ||
+			int(r.offset)+r.typ.Size() > len(o.SecTab[r.sec]) {
+			return fmt.Errorf("relocation of %s outside %s section at %04x",
+				sym.name, r.sec, r.offset)
+		}
+		v := int(o.Base(sym.sec)) + int(sym.addr) + int(r.addend)
+		if r.typ == PC8 {
+			v -= int(o.Base(r.sec)) + int(r.offset)
+		}
+		if (r.typ == PC8 && (v < -0x80 || v > 0x7f)) ||
+			(r.typ != PC8 && (v < 0 || v > 0xffff)) {
+			return fmt.Errorf("%s relocation of %s out of range at %s:%04x: %d",
+				r.typ, r.Ref(sym.name), r.sec, r.offset, v)
+		}
+		b := o.SecTab[r.sec][r.offset:]
+		switch r.typ {
+		case ABS16:
+			copy(b, toBytes(uint16(v)))
+		case LO8, PC8:
+			b[0] = byte(v)
+		case HI8:
+			b[0] = byte(v >> 8)
+		default:
+			return fmt.Errorf("invalid relocation type: %s", r.typ)
 		}
 	}
+	return nil
 }
 
 func (o *Object) MergeRelocates(other RelocateTable) error {
@@ -358,40 +728,68 @@ func (o *Object) MergeRelocates(other RelocateTable) error {
 }
 
 func (rt RelocateTable) Size() uint16 {
-	return uint16(len(rt) * 3)
+	return uint16(len(rt) * relocSize)
 }
 
-func (o *Object) updateRelocations(addend uint16) {
-	for i, r := range o.RelocTab {
-		if o.SymTab[r.index].sec == TEXT {
+// updateRelocations moves every relocation within sec by addend
+func (o *Object) updateRelocations(sec SecType, addend uint16) {
+	for i := range o.RelocTab {
+		if o.RelocTab[i].sec == sec {
 			o.RelocTab[i].offset += addend
 		}
 	}
 }
 
-func (o *Object) updateRelocationIndexes(from, to byte) {
+// updateRelocationIndexes points each relocation at the symbol index
+// given by idx for its current index
+func (o *Object) updateRelocationIndexes(idx []byte) {
 	for i, r := range o.RelocTab {
-		if r.index == from {
-			o.RelocTab[i].index = to
+		if int(r.index) < len(idx) {
+			o.RelocTab[i].index = idx[r.index]
 		}
 	}
 }
 
+// Binding determines which objects a symbol is visible to when linking
+type Binding byte
+
+const (
+	LOCAL  Binding = iota // visible only within its own object
+	GLOBAL                // visible to all objects, must be unique
+	WEAK                  // global but gives way to a global of the same name
+)
+
+var bindings = []string{
+	LOCAL:  "local",
+	GLOBAL: "global",
+	WEAK:   "weak",
+}
+
+func (b Binding) String() string {
+	if int(b) < len(bindings) {
+		return bindings[b]
+	}
+	return fmt.Sprintf("binding(%d)", byte(b))
+}
+
 // Symbol represent an addressable location associated with a label.
 // Function and variable names are examples
 type Symbol struct {
 	name string
 	sec  SecType
+	bind Binding
 	addr uint16
+	size uint16 // set when linked, see Len
 }
 
 func ScanSymbol(b []byte) Symbol {
 	//fmt.Println("scansym", len(b), ":", b)
-	sz := b[3]
+	sz := b[4]
 	return Symbol{
 		addr: toAddress(b[:2]),
 		sec:  SecType(b[2]),
-		name: string(b[4 : 4+sz]),
+		bind: Binding(b[3]),
+		name: string(b[5 : 5+sz]),
 	}
 }
 
@@ -399,46 +797,103 @@ func (s Symbol) Address() uint16 {
 	return s.addr
 }
 
+func (s Symbol) Name() string {
+	return s.name
+}
+
+func (s Symbol) Section() SecType {
+	return s.sec
+}
+
+func (s Symbol) Binding() Binding {
+	return s.bind
+}
+
+// Len returns the number of bytes the symbol labels, which runs up to the
+// next symbol in its section or the end of the section. It is only known
+// once the symbol has been merged by the linker.
+func (s Symbol) Len() uint16 {
+	return s.size
+}
+
 func (s Symbol) Bytes() []byte {
 	b := toBytes(s.addr)
-	b = append(b, byte(s.sec), byte(len(s.name)))
+	b = append(b, byte(s.sec), byte(s.bind), byte(len(s.name)))
 	b = append(b, []byte(s.name)...)
 
 	return b
 }
 
 func (s Symbol) Size() uint16 {
-	return uint16(len(s.name) + 4)
+	return uint16(len(s.name) + 5)
 }
 
 // SymbolTable is a list of all Symbols found in the object/program
 type SymbolTable []Symbol
 
-func (o *Object) ScanSymbolTable(b []byte) {
+func (o *Object) ScanSymbolTable(b []byte) error {
+	return o.SymTab.scan(b)
+}
+
+func (st *SymbolTable) scan(b []byte) error {
 	for i := 0; i < len(b); {
+		if i+5 > len(b) || i+5+int(b[i+4]) > len(b) {
+			return errors.New("invalid symbol table")
+		}
 		s := ScanSymbol(b[i:])
-		o.SymTab = append(o.SymTab, s)
+		*st = append(*st, s)
 		i += int(s.Size())
 	}
-	return
+	return nil
 }
 
+// AddSymbol adds a global symbol to the symbol table. Names must be unique
+// within an object.
 func (o *Object) AddSymbol(name string, sec SecType, addr uint16) (int, error) {
-	var i int
-	for _, sym := range o.SymTab {
-		if sym.name == name {
-			return 0, fmt.Errorf("duplicate name: %s", name)
-		}
-		i++
+	if _, ok := o.SymTab.index(name); ok {
+		return 0, fmt.Errorf("duplicate name: %s", name)
+	}
+	return o.addSymbol(Symbol{addr: addr, sec: sec, bind: GLOBAL, name: name})
+}
+
+// maxSymbols is the most symbols an object may hold. Relocations refer to
+// symbols by a single byte index and 255 is never a valid one.
+const maxSymbols = 255
+
+func (o *Object) addSymbol(s Symbol) (int, error) {
+	if len(o.SymTab) >= maxSymbols {
+		return 0, fmt.Errorf("too many symbols, at most %d may be defined or "+
+			"referred to: %s", maxSymbols, s.name)
 	}
-	o.SymTab = append(o.SymTab, Symbol{addr: addr, sec: sec, name: name})
+	o.SymTab = append(o.SymTab, s)
+	return len(o.SymTab) - 1, nil
+}
 
-	// TODO kind of a wonky hack since language doesn't have a way to mark
-	// a function as the entry point...
-	if name == "main" {
-		o.Entry = addr
+// SetEntry sets the entry point to the text symbol called name, preferring
+// a global or weak symbol to a local one
+func (o *Object) SetEntry(name string) error {
+	i, ok := o.SymTab.global(name)
+	if !ok {
+		i, ok = o.SymTab.index(name)
 	}
-	return i, nil
+	switch {
+	case !ok, o.SymTab[i].sec == UNDEF:
+		return fmt.Errorf("entry point not defined: %s", name)
+	case o.SymTab[i].sec != TEXT:
+		return fmt.Errorf("entry point not in text: %s", name)
+	}
+	o.Entry, o.HasEntry = o.SymTab[i].addr, true
+	return nil
+}
+
+// Bind sets the binding of the symbol called name
+func (o *Object) Bind(name string, b Binding) error {
+	i, ok := o.SymTab.index(name)
+	if !ok {
+		return fmt.Errorf("no such symbol: %s", name)
+	}
+	o.SymTab[i].bind = b
+	return nil
 }
 
 func (st SymbolTable) Bytes() []byte {
@@ -449,17 +904,50 @@ func (st SymbolTable) Bytes() []byte {
 	return b
 }
 
+// MergeSymbols adds the symbols of other to the symbol table. Local
+// symbols are always added. Undefined, global and weak symbols are resolved
+// against the other non-local symbols of the same name: a global replaces
+// an undefined or weak symbol, a weak symbol only replaces an undefined
+// one and two globals conflict.
 func (o *Object) MergeSymbols(other *Object) error {
+	idx := make([]byte, len(other.SymTab))
 	for i, sym := range other.SymTab {
-		x, err := o.AddSymbol(sym.name, sym.sec, sym.addr)
-		if err != nil {
-			return err
+		x, ok := -1, false
+		if sym.bind != LOCAL {
+			x, ok = o.SymTab.global(sym.name)
 		}
-		other.updateRelocationIndexes(byte(i), byte(x))
+		var err error
+		switch {
+		case !ok:
+			if x, err = o.addSymbol(sym); err != nil {
+				return err
+			}
+		case sym.sec == UNDEF:
+			// already defined, or equally undefined, in o
+		case o.SymTab[x].sec == UNDEF,
+			o.SymTab[x].bind == WEAK && sym.bind == GLOBAL:
+			o.SymTab[x] = sym
+		case o.SymTab[x].bind == GLOBAL && sym.bind == GLOBAL:
+			return fmt.Errorf("duplicate name: %s", sym.name)
+		}
+		idx[i] = byte(x)
 	}
+	other.updateRelocationIndexes(idx)
 	return nil
 }
 
+// Undefined returns the names of symbols which are referred to but not
+// defined
+func (o *Object) Undefined() []string {
+	names := make([]string, 0)
+	for _, s := range o.SymTab {
+		if s.sec == UNDEF {
+			names = append(names, s.name)
+		}
+	}
+	return names
+}
+
 func (o *Object) LookupSymbolIndex(name string) byte {
 	for i, s := range o.SymTab {
 		if name == s.name {
@@ -469,6 +957,43 @@ func (o *Object) LookupSymbolIndex(name string) byte {
 	return 255
 }
 
+func (st SymbolTable) index(name string) (int, bool) {
+	for i, s := range st {
+		if name == s.name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// setSizes sets the size of each defined symbol from the layout of the
+// symbols in secs. Symbols at the same address share the same bytes.
+func (st SymbolTable) setSizes(secs SectionTable) {
+	for i, s := range st {
+		if s.sec == UNDEF || int(s.sec) >= len(secs) ||
+			int(s.addr) >= len(secs[s.sec]) {
+			continue
+		}
+		end := uint16(len(secs[s.sec]))
+		for _, n := range st {
+			if n.sec == s.sec && n.addr > s.addr && n.addr < end {
+				end = n.addr
+			}
+		}
+		st[i].size = end - s.addr
+	}
+}
+
+// global finds the non-local symbol called name
+func (st SymbolTable) global(name string) (int, bool) {
+	for i, s := range st {
+		if name == s.name && s.bind != LOCAL {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
 func (st SymbolTable) Lookup(name string) (Symbol, bool) {
 	for _, s := range st {
 		if name == s.name {
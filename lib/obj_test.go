@@ -2,7 +2,10 @@ package vm_test
 
 import (
 	"bytes"
+	"fmt"
+	"go/token"
 	"log"
+	"strings"
 	"testing"
 
 	vm "github.com/rthornton128/vm/lib"
@@ -12,8 +15,13 @@ func TestRelocateTable(t *testing.T) {
 	o := vm.NewObject()
 	o.AddRelocate(0x42, 0xabcd)
 	o.AddRelocate(0xff, 0x1234)
+	o.AddRelocateType(vm.DATA, vm.HI8, 0x7, 0x3, -2)
 	b := o.RelocTab.Bytes()
-	expect := []byte{0x42, 0xab, 0xcd, 0xff, 0x12, 0x34}
+	expect := []byte{
+		0x42, 0xab, 0xcd, byte(vm.TEXT), byte(vm.ABS16), 0x0, 0x0,
+		0xff, 0x12, 0x34, byte(vm.TEXT), byte(vm.ABS16), 0x0, 0x0,
+		0x7, 0x0, 0x3, byte(vm.DATA), byte(vm.HI8), 0xff, 0xfe,
+	}
 
 	if !bytes.Equal(b, expect) {
 		t.Log("expected:", expect, "got:", b)
@@ -22,6 +30,9 @@ func TestRelocateTable(t *testing.T) {
 
 	o2 := vm.NewObject()
 	o2.ScanRelocateTable(b)
+	if len(o2.RelocTab) != len(o.RelocTab) {
+		t.Fatal("expected", len(o.RelocTab), "relocations, got", o2.RelocTab)
+	}
 	for i, r := range o2.RelocTab {
 		if r != o.RelocTab[i] {
 			t.Log("expected:", r, "got:", o.RelocTab[i])
@@ -109,7 +120,8 @@ func TestSymbol(t *testing.T) {
 	o := vm.NewObject()
 	o.AddSymbol("main", vm.TEXT, uint16(0x3))
 	b := o.SymTab[0].Bytes()
-	expect := []byte{0x0, 0x3, byte(vm.TEXT), 0x4, 'm', 'a', 'i', 'n'}
+	expect := []byte{0x0, 0x3, byte(vm.TEXT), byte(vm.GLOBAL), 0x4,
+		'm', 'a', 'i', 'n'}
 
 	if !bytes.Equal(b, expect) {
 		t.Log("expected:", expect, "got:", b)
@@ -130,8 +142,8 @@ func TestSymbolTable(t *testing.T) {
 
 	b := o.SymTab.Bytes()
 	expect := []byte{
-		0xab, 0xcd, byte(vm.DATA), 0x3, 'f', 'o', 'o',
-		0x12, 0x34, byte(vm.TEXT), 0x3, 'b', 'a', 'r',
+		0xab, 0xcd, byte(vm.DATA), byte(vm.GLOBAL), 0x3, 'f', 'o', 'o',
+		0x12, 0x34, byte(vm.TEXT), byte(vm.GLOBAL), 0x3, 'b', 'a', 'r',
 	}
 
 	if !bytes.Equal(b, expect) {
@@ -140,7 +152,9 @@ func TestSymbolTable(t *testing.T) {
 	}
 
 	o2 := vm.NewObject()
-	o2.ScanSymbolTable(b)
+	if err := o2.ScanSymbolTable(b); err != nil {
+		t.Fatal(err)
+	}
 	for i, s := range o2.SymTab {
 		if s != o.SymTab[i] {
 			t.Log("expected:", o.SymTab, "got:", o2.SymTab)
@@ -185,7 +199,7 @@ func TestSymbolTableMerg(t *testing.T) {
 
 func TestObject(t *testing.T) {
 	o := vm.NewObject()
-	o.Entry = 0x03
+	o.Entry, o.HasEntry = 0x03, true
 	o.SecTab = vm.SectionTable{
 		vm.TEXT: []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8, 0x9, 0xa},
 		vm.DATA: make([]byte, 0, 0),
@@ -198,15 +212,18 @@ func TestObject(t *testing.T) {
 	expect := []byte{
 		0xd, 0xe, 0xa, 0xd, 0xb, 0xe, 0xe, 0xf, // magic #
 		0x0, 0x3, // entry pt
-		0x0, 0x16, // reladdr
-		0x0, 0x3, // relsize
-		0x0, 0x19, // symaddr
-		0x0, 0xe, // symsize
-		0x0, 0x27, // secaddr
+		0x0, 0x1b, // reladdr
+		0x0, 0x7, // relsize
+		0x0, 0x22, // symaddr
+		0x0, 0x10, // symsize
+		0x0, 0x32, // secaddr
 		0x0, 0xf, // secsize
-		0x2, 0x0, 0x6, // reloc1
-		0x0, 0x0, byte(vm.TEXT), 0x2, 'f', 'n', // symbol 1
-		0x0, 0x3, byte(vm.TEXT), 0x4, 'm', 'a', 'i', 'n', // symbol 2
+		0x0, 0x42, // lineaddr
+		0x0, 0x0, // linesize
+		0x3,                                                    // flags, has entry and typed relocations
+		0x2, 0x0, 0x6, byte(vm.TEXT), byte(vm.ABS16), 0x0, 0x0, // reloc1
+		0x0, 0x0, byte(vm.TEXT), byte(vm.GLOBAL), 0x2, 'f', 'n', // symbol 1
+		0x0, 0x3, byte(vm.TEXT), byte(vm.GLOBAL), 0x4, 'm', 'a', 'i', 'n', // symbol 2
 		0x1,                     // 1 section
 		0x0, 0x0, 0x6, 0x0, 0xa, // section text, len 11
 		0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8, 0x9, 0xa, // text
@@ -221,7 +238,7 @@ func TestObject(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if ob.Entry != o.Entry {
+	if ob.Entry != o.Entry || !ob.HasEntry {
 		t.Log("expected:", expect, "got:", b)
 		t.FailNow()
 	}
@@ -274,7 +291,7 @@ func TestObjectMergeFull(t *testing.T) {
 	o1.AddSymbol("blah", vm.TEXT, 0x0)
 
 	o2 := vm.NewObject()
-	o2.Entry = 0x2 // this will fail because merge won't take relocate into account
+	o2.Entry, o2.HasEntry = 0x2, true
 	o2.SecTab[vm.TEXT] = []byte{0x0, 0x0, 0xff}
 	o2.SecTab[vm.DATA] = []byte{0x2}
 	o2.AddRelocate(0, 0x0)
@@ -282,7 +299,7 @@ func TestObjectMergeFull(t *testing.T) {
 
 	exp := vm.NewObject()
 	exp.Entry = 0x4
-	exp.SecTab[vm.TEXT] = []byte{0x0, 0x0, 0x0, 0x2, 0xff}
+	exp.SecTab[vm.TEXT] = []byte{0x0, 0x5, 0x0, 0x2, 0xff} // data follows text
 	exp.SecTab[vm.DATA] = []byte{0x1, 0x2}
 	exp.AddRelocate(0, 0x0)
 	exp.AddRelocate(3, 0x2)
@@ -311,3 +328,264 @@ func TestObjectMergeFull(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestProgram(t *testing.T) {
+	o := vm.NewObject()
+	o.Entry = 0x1
+	o.SecTab[vm.TEXT] = []byte{0x1, 0x2, 0x3}
+	o.SecTab[vm.DATA] = []byte{0xa, 0xb}
+
+	p, err := vm.ScanProgram(vm.NewProgram(o).Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Entry != o.Entry {
+		t.Fatal("expected entry", o.Entry, "got", p.Entry)
+	}
+	for i := range o.SecTab {
+		if !bytes.Equal(p.SecTab[i], o.SecTab[i]) {
+			t.Fatal("expected", o.SecTab[i], "got", p.SecTab[i])
+		}
+	}
+	if p.SecTab.Base(vm.DATA) != 3 {
+		t.Fatal("expected data at", 3, "got", p.SecTab.Base(vm.DATA))
+	}
+}
+
+func TestObjectMergeUndefined(t *testing.T) {
+	o1 := vm.NewObject()
+	o1.SecTab[vm.TEXT] = []byte{byte(vm.CALL), 0x0, 0x0}
+	o1.AddSymbol("main", vm.TEXT, 0x0)
+	o1.AddSymbol("sub", vm.UNDEF, 0x0)
+	o1.AddRelocate(1, 0x1)
+
+	o2 := vm.NewObject()
+	o2.SecTab[vm.TEXT] = []byte{byte(vm.RET), byte(vm.JMP), 0x0, 0x0}
+	o2.AddSymbol("main", vm.UNDEF, 0x0)
+	o2.AddSymbol("sub", vm.TEXT, 0x0)
+	o2.AddRelocate(0, 0x2)
+
+	o := vm.NewObject()
+	if err := o.Merge(o1, o2); err != nil {
+		t.Fatal(err)
+	}
+	if u := o.Undefined(); len(u) != 0 {
+		t.Fatal("expected no undefined symbols, got", u)
+	}
+
+	expect := []byte{byte(vm.CALL), 0x0, 0x3, byte(vm.RET), byte(vm.JMP),
+		0x0, 0x0}
+	if !bytes.Equal(o.SecTab[vm.TEXT], expect) {
+		t.Fatal("expected", expect, "got", o.SecTab[vm.TEXT])
+	}
+}
+
+func TestObjectMergeBinding(t *testing.T) {
+	o1 := vm.NewObject()
+	o1.SecTab[vm.TEXT] = []byte{byte(vm.RET), byte(vm.RET)}
+	o1.AddSymbol("loop", vm.TEXT, 0x0)
+	o1.Bind("loop", vm.LOCAL)
+	o1.AddSymbol("fn", vm.TEXT, 0x1)
+	o1.Bind("fn", vm.WEAK)
+
+	o2 := vm.NewObject()
+	o2.SecTab[vm.TEXT] = []byte{byte(vm.RET)}
+	o2.AddSymbol("loop", vm.TEXT, 0x0)
+	o2.Bind("loop", vm.LOCAL)
+	o2.AddSymbol("fn", vm.TEXT, 0x0)
+
+	o := vm.NewObject()
+	if err := o.Merge(o1, o2); err != nil {
+		t.Fatal(err)
+	}
+	if len(o.SymTab) != 3 {
+		t.Fatal("expected 3 symbols, got", o.SymTab)
+	}
+	if s, _ := o.SymTab.Lookup("fn"); s.Address() != 0x2 {
+		t.Fatal("expected global fn to replace weak fn, got", s)
+	}
+
+	o3 := vm.NewObject()
+	o3.SecTab[vm.TEXT] = []byte{byte(vm.RET)}
+	o3.AddSymbol("fn", vm.TEXT, 0x0)
+	if err := o.Merge(o3); err == nil {
+		t.Fatal("expected error, got none")
+	}
+}
+
+func TestProgramSymbols(t *testing.T) {
+	o := vm.NewObject()
+	o.SecTab[vm.TEXT] = []byte{0x1, 0x2, 0x3, 0x4}
+	o.SecTab[vm.DATA] = []byte{0xa, 0xb}
+	o.AddSymbol("main", vm.TEXT, 0)
+	o.AddSymbol("f", vm.TEXT, 2)
+	o.AddSymbol("x", vm.DATA, 1)
+	o.AddSymbol("ext", vm.UNDEF, 0)
+
+	p, err := vm.ScanProgram(vm.NewProgram(o).Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.HasSymbols() || len(p.SymTab) != 3 {
+		t.Fatal("expected 3 defined symbols, got", p.SymTab)
+	}
+	m := p.AddressMap()
+	for name, addr := range map[string]uint16{"main": 0, "f": 2, "x": 5} {
+		if a, ok := m.Address(name); !ok || a != addr {
+			t.Fatal("expected", name, "at", addr, "got", a, ok)
+		}
+	}
+	if name, off, ok := p.Lookup(3); !ok || name != "f" || off != 1 {
+		t.Fatal("expected f+1, got", name, off, ok)
+	}
+	if name, off, ok := p.Lookup(0xff06); ok {
+		t.Fatal("expected no symbol at ff06, got", name, off)
+	}
+
+	sp := vm.NewProgram(o)
+	sp.Strip()
+	p, err = vm.ScanProgram(sp.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.HasSymbols() {
+		t.Fatal("expected stripped program to have no symbols")
+	}
+	if !bytes.Equal(p.SecTab[vm.DATA], o.SecTab[vm.DATA]) {
+		t.Fatal("expected", o.SecTab[vm.DATA], "got", p.SecTab[vm.DATA])
+	}
+
+	// programs without a symbol table header are still readable
+	old := append([]byte{}, vm.MagicNumber...)
+	old = append(old, 0, 0, 0, 6, 0, 10)
+	old = append(old, o.SecTab.Bytes()...)
+	p, err = vm.ScanProgram(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.HasSymbols() || !bytes.Equal(p.SecTab[vm.TEXT], o.SecTab[vm.TEXT]) {
+		t.Fatal("expected old program text", o.SecTab[vm.TEXT], "got", p.SecTab[vm.TEXT])
+	}
+}
+
+func TestProgramLayout(t *testing.T) {
+	o := vm.NewObject()
+	o.Layout.SetBase(vm.TEXT, 0x100)
+	o.Layout.SetStack(0x8000, 0x20)
+	if err := o.Merge(encode(t, `.text
+main:
+lda $x
+ret
+.data
+x: .byte 1
+`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.CheckLayout(); err != nil {
+		t.Fatal(err)
+	}
+	// the data follows the text, wherever it is
+	if text := o.SecTab[vm.TEXT]; text[1] != 0x1 || text[2] != 0x4 {
+		t.Fatal("expected x to be relocated to 0104, got", text)
+	}
+
+	p, err := vm.ScanProgram(vm.NewProgram(o).Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Entry != 0x100 || p.Base(vm.TEXT) != 0x100 || p.Base(vm.DATA) != 0x104 {
+		t.Fatal("expected entry and text at 0100 and data at 0104, got",
+			p.Entry, p.Base(vm.TEXT), p.Base(vm.DATA))
+	}
+	if sb, size := p.Stack(); sb != 0x8000 || size != 0x20 {
+		t.Fatal("expected stack at 8000 of 32 bytes, got", sb, size)
+	}
+	if a, _ := p.AddressMap().Address("x"); a != 0x104 {
+		t.Fatal("expected x at 0104, got", a)
+	}
+
+	o.Layout.SetBase(vm.DATA, 0x102)
+	if err := o.CheckLayout(); err == nil {
+		t.Fatal("expected data to overlap text")
+	}
+
+	// sections and the stack must stay below the devices
+	var tests = []struct {
+		text, data, stack uint16
+		err               string
+	}{
+		{0xfefc, 0x200, 0x300, ""},
+		{0xfefd, 0x200, 0x300, "text at fefd overlaps devices at ff00"},
+		{0x100, 0xff00, 0x300, "data at ff00 overlaps devices at ff00"},
+		{0x100, 0x200, 0xfef0, "stack at fef0 overlaps devices at ff00"},
+	}
+	for _, test := range tests {
+		o.Layout.SetBase(vm.TEXT, test.text)
+		o.Layout.SetBase(vm.DATA, test.data)
+		o.Layout.SetStack(test.stack, 0x20)
+		err := o.CheckLayout()
+		switch {
+		case test.err == "" && err != nil:
+			t.Fatal("expected no error, got", err)
+		case test.err != "" && (err == nil || err.Error() != test.err):
+			t.Fatal("expected error", test.err, "got", err)
+		}
+	}
+}
+
+// labels returns the source of n subroutines named after prefix
+func labels(prefix string, n int) string {
+	b := new(strings.Builder)
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(b, "%s%d:\nret\n", prefix, i)
+	}
+	return b.String()
+}
+
+func TestSymbolLimit(t *testing.T) {
+	// local symbols are kept when merging so 201 symbols fit
+	o := vm.NewObject()
+	err := o.Merge(encode(t, ".text\nmain:\ncall $g\n"+labels("a", 99)),
+		encode(t, ".global g\n.text\n"+labels("b", 100)+"g:\nret\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(o.SymTab) != 201 {
+		t.Fatal("expected 201 symbols, got", len(o.SymTab))
+	}
+	// main and a0-a98 take 102 bytes, b0-b99 a further 100
+	if b := o.SecTab[vm.TEXT][1:3]; !bytes.Equal(b, []byte{0x00, 0xca}) {
+		t.Fatalf("expected call to g at 00ca, got % x", b)
+	}
+
+	// but more than 255 don't fit an index
+	err = o.Merge(encode(t, ".text\n"+labels("c", 100)))
+	if err == nil || !strings.Contains(err.Error(), "too many symbols") {
+		t.Fatal("expected too many symbols error, got", err)
+	}
+
+	src := ".text\n" + labels("d", 300)
+	f := token.NewFileSet().AddFile("test.a", -1, len(src))
+	err = vm.NewEncoder(f, new(bytes.Buffer)).Encode(strings.NewReader(src))
+	if err == nil || !strings.Contains(err.Error(), "too many symbols") {
+		t.Fatal("expected too many symbols error, got", err)
+	}
+}
+
+func TestScanObjectTruncated(t *testing.T) {
+	b := encode(t, ".text\nmain:\ncall $f\nret\nf:\nret\n.data\nx: .word $f\n").Bytes()
+	for n := 0; n < len(b); n++ {
+		if _, err := vm.ScanObject(b[:n]); err == nil {
+			t.Fatal("expected error for object truncated to", n, "bytes")
+		}
+	}
+
+	// table addresses and sizes, and symbol name lengths, out of range
+	for _, off := range []int{11, 13, 15, 17, 19, 21, 23, 25, 27 + 7*2 + 4} {
+		c := append([]byte{}, b...)
+		c[off] = 0xff
+		if _, err := vm.ScanObject(c); err == nil {
+			t.Fatalf("expected error for %02x at %d", c[off], off)
+		}
+	}
+}
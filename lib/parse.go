@@ -1,27 +1,31 @@
 package vm
 
 import (
-	"errors"
 	"fmt"
 	"go/token"
 	"io"
-	"log"
+	"strconv"
+	"strings"
 
 	"github.com/rthornton128/gct/lex"
 )
 
 type Parser struct {
+	file   *token.File
 	lexer  *lex.Lex
-	errors []error
+	errors ErrorList
 	offset int
 
 	item lex.Item
 }
 
-func Parse(f *token.File, r io.Reader) (*File, []error) {
+// Parse parses the source read from r. Any errors are returned as a sorted
+// ErrorList holding at most one error per line.
+func Parse(f *token.File, r io.Reader) (*File, error) {
 	p := newParser(f, r)
 	file := p.parseFile()
-	return file, p.errors
+	p.errors.RemoveMultiples()
+	return file, p.errors.Err()
 }
 
 func newParser(f *token.File, r io.Reader) *Parser {
@@ -30,48 +34,112 @@ func newParser(f *token.File, r io.Reader) *Parser {
 	l := lex.NewLex(s)
 	l.Symbols = symbols
 	p := &Parser{
-		lexer:  l,
-		errors: make([]error, 0),
+		file:  f,
+		lexer: l,
 	}
 	p.next()
 	return p
 }
 
 func (p *Parser) error(args ...interface{}) {
-	p.errors = append(p.errors,
-		errors.New(fmt.Sprint("line: ", p.item.Pos, " - ", args)))
+	p.errorAt(p.item.Pos, args...)
+}
+
+func (p *Parser) errorAt(pos token.Pos, args ...interface{}) {
+	p.errors.Add(p.file.Position(pos),
+		strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
 }
 
 func (p *Parser) expect(t lex.Token) {
 	if p.item.Tok != t {
 		//fmt.Println("expected", t, "got:", p.tok, " (", p.lit, ")")
-		p.error("expected", t, "got:", p.item.Tok, " (", p.item.Lit, ")")
+		p.error("expected", t, "got:", p.item.Tok, "("+p.item.Lit+")")
 	}
 	p.next()
 }
 
+// addend parses the signed offset which may follow a symbol
+func (p *Parser) addend() string {
+	switch p.item.Tok {
+	case PLUS:
+		p.next()
+		return p.literal()
+	case MINUS:
+		p.next()
+		return "-" + p.literal()
+	case lex.INT:
+		// the minus sign may be scanned as part of the literal
+		if strings.HasPrefix(p.item.Lit, "-") {
+			return p.literal()
+		}
+	}
+	return ""
+}
+
+// ref parses a symbol prefixed by a dollar sign, optionally followed by an
+// addend such as $table+2, for its 16-bit address. Wrapped in lo, hi or rel
+// it instead refers to the low or high byte of the address or its distance
+// from the operand, such as lo($table+2).
+func (p *Parser) ref() *Ref {
+	r := &Ref{Type: ABS16, Pos: p.item.Pos}
+	wrapped := false
+	if p.item.Tok == lex.IDENT {
+		switch p.item.Lit {
+		case "lo":
+			r.Type, wrapped = LO8, true
+		case "hi":
+			r.Type, wrapped = HI8, true
+		case "rel":
+			r.Type, wrapped = PC8, true
+		}
+	}
+	if wrapped {
+		p.next()
+		p.expect(LPAREN)
+	}
+	p.expect(DOLLAR)
+	r.Name = p.ident()
+	r.Addend = p.addend()
+	if wrapped {
+		p.expect(RPAREN)
+	}
+	return r
+}
+
+// value parses either a literal or a reference to a symbol
+func (p *Parser) value() (string, *Ref) {
+	if p.item.Tok == lex.INT {
+		return p.literal(), nil
+	}
+	return "", p.ref()
+}
+
 func (p *Parser) ident() string {
 	l := p.item.Lit
 	p.expect(lex.IDENT)
 	return l
 }
 
-func (p *Parser) instruction(id string) *Instruction {
+func (p *Parser) instruction(pos token.Pos, id string) *Instruction {
 	i, err := LookupOpcode(id)
 	if err != nil {
-		log.Fatal(err)
+		p.errorAt(pos, err)
+		return nil
+	}
+
+	switch {
+	case i.IsJump(), i == CALL, i == LIV:
+		return &Instruction{Op: i, Ref: p.ref(), Pos: pos}
+	case i.HasRegister():
+		return &Instruction{Op: i | Opcode(p.register()), Pos: pos}
 	}
 
 	switch i {
-	case JMP, CALL:
-		p.expect(DOLLAR)
-		return &Instruction{Op: i, Value: p.ident()}
-	case JPZ, JNZ, MVI:
-		return &Instruction{Op: i, Value: p.literal()}
-	case CLA, INC, NOP, POP, PUSH, RET:
-		return &Instruction{Op: i}
+	case MVI, LDA, STA:
+		v, r := p.value()
+		return &Instruction{Op: i, Value: v, Ref: r, Pos: pos}
 	default:
-		return &Instruction{Op: i | Opcode(p.register())}
+		return &Instruction{Op: i, Pos: pos}
 	}
 }
 
@@ -81,6 +149,21 @@ func (p *Parser) literal() string {
 	return l
 }
 
+// valueList parses comma separated values, returning the literals along
+// with the references to symbols used in place of any of them
+func (p *Parser) valueList() ([]string, []*Ref) {
+	var list []string
+	var refs []*Ref
+	for {
+		v, r := p.value()
+		list, refs = append(list, v), append(refs, r)
+		if p.item.Tok != COMMA {
+			return list, refs
+		}
+		p.next()
+	}
+}
+
 func (p *Parser) next() {
 	p.item = p.lexer.Lex()
 	//fmt.Println("next:", p.lit, p.tok, p.pos)
@@ -96,48 +179,154 @@ func (p *Parser) register() Register {
 	return r
 }
 
+// skip advances to the next section marker, or the end of the file, after
+// an error from which the current section can't recover
+func (p *Parser) skip() {
+	for p.item.Tok != DOT && p.item.Tok != lex.EOF {
+		p.next()
+	}
+}
+
+func (p *Parser) str() string {
+	l := p.item.Lit
+	p.expect(lex.STRING)
+	s, err := strconv.Unquote(l)
+	if err != nil {
+		p.error("invalid string literal:", l)
+	}
+	return s
+}
+
+// strList parses comma separated string literals
+func (p *Parser) strList() []string {
+	var list []string
+	for {
+		list = append(list, p.str())
+		if p.item.Tok != COMMA {
+			return list
+		}
+		p.next()
+	}
+}
+
 func (p *Parser) parseFile() *File {
 	sections := make([]Section, 0)
+	decls := make([]*Decl, 0)
+	var entries []*Decl
+	var cur string // section to resume after a directive
 	for p.item.Tok != lex.EOF {
-		p.expect(DOT)
-		ident := p.ident()
+		ident := cur
+		pos := p.item.Pos
+		if p.item.Tok == DOT || cur == "" {
+			p.expect(DOT)
+			pos = p.item.Pos
+			ident = p.ident()
+		}
 		switch ident {
+		case "data":
+			cur = ident
+			sections = append(sections, p.sectionData())
 		case "text":
+			cur = ident
 			sections = append(sections, p.sectionText())
+		case "global", "weak", "extern":
+			decls = append(decls, p.declaration(ident)...)
+		case "entry":
+			d := &Decl{Pos: p.item.Pos}
+			d.Name = p.ident()
+			entries = append(entries, d)
 		default:
-			p.error("expected valid section name, got", p.item.Lit)
-			return nil
+			p.errorAt(pos, "expected valid section name or directive, got",
+				ident)
+			p.skip()
 		}
 	}
 
-	return &File{sections: sections}
+	return &File{sections: sections, decls: decls, entries: entries}
+}
+
+// declaration parses the comma separated names following a .global, .weak
+// or .extern directive
+func (p *Parser) declaration(kind string) []*Decl {
+	decls := make([]*Decl, 0)
+	for {
+		d := &Decl{Pos: p.item.Pos, Bind: GLOBAL, Extern: kind == "extern"}
+		if kind == "weak" {
+			d.Bind = WEAK
+		}
+		d.Name = p.ident()
+		decls = append(decls, d)
+		if p.item.Tok != COMMA {
+			return decls
+		}
+		p.next()
+	}
 }
 
-/*
 func (p *Parser) sectionData() *DataSection {
-	// parse label and literal pairs until next section marker found
-	data := make(map[string]byte)
-	for p.tok == IDENT { //&& p.tok != EOF {
-		lab := p.ident()
+	// parse labelled initialisers until next section marker found
+	data := make([]*Data, 0)
+	for p.item.Tok != DOT && p.item.Tok != lex.EOF {
+		if p.item.Tok != lex.IDENT {
+			p.error("expected label, got", p.item.Lit)
+			p.next()
+			continue
+		}
+		pos := p.item.Pos
+		d := &Data{Name: p.ident(), Pos: pos}
 		p.expect(COLON)
-		data[lab] = p.literal()
-		//p.stab[lab] = p.offset
-		//p.offset++
+		p.expect(DOT)
+		t, err := LookupDataType(p.item.Lit)
+		if err != nil {
+			p.error(err)
+			// skip the values of the bad initialiser
+			p.next()
+			for p.item.Tok == lex.INT || p.item.Tok == lex.STRING ||
+				p.item.Tok == COMMA {
+				p.next()
+			}
+			continue
+		}
+		p.next()
+		d.Type = t
+
+		switch t {
+		case STRING:
+			d.Values = p.strList()
+		default:
+			d.Values, d.Refs = p.valueList()
+		}
+		data = append(data, d)
 	}
-	return &DataSection{m: data}
-}*/
+	return &DataSection{d: data}
+}
 
 func (p *Parser) sectionText() *TextSection {
-	text := make(map[string][]*Instruction)
-	var sub string
-	for p.item.Tok == lex.IDENT {
+	text := new(TextSection)
+	var sub *Sub
+	for p.item.Tok != DOT && p.item.Tok != lex.EOF {
+		if p.item.Tok != lex.IDENT {
+			p.error("expected label or instruction, got", p.item.Lit)
+			p.next()
+			continue
+		}
+		pos := p.item.Pos
 		id := p.ident()
 		if p.item.Tok == COLON { // new subroutine
-			sub = id
+			sub = &Sub{Name: id, Pos: pos}
+			text.subs = append(text.subs, sub)
 			p.next()
 			continue
 		}
-		text[sub] = append(text[sub], p.instruction(id))
+		i := p.instruction(pos, id)
+		if i == nil {
+			continue
+		}
+		if sub == nil {
+			sub = &Sub{Pos: pos}
+			text.subs = append(text.subs, sub)
+		}
+		sub.Insts = append(sub.Insts, i)
 	}
-	return &TextSection{m: text}
+	return text
 }
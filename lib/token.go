@@ -7,4 +7,9 @@ const (
 	DOT
 	COLON
 	DOLLAR
+	COMMA
+	LPAREN
+	RPAREN
+	PLUS
+	MINUS
 )
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	vm "github.com/rthornton128/vm/lib"
+)
+
+var (
+	headers  = flag.Bool("h", false, "display the file header")
+	sections = flag.Bool("s", false, "display the section table and contents")
+	symbols  = flag.Bool("t", false, "display the symbol table")
+	relocs   = flag.Bool("r", false, "display the relocation table")
+	disasm   = flag.Bool("d", false, "disassemble the text section")
+	lineNums = flag.Bool("l", false, "show source lines in the disassembly")
+	all      = flag.Bool("x", false, "display everything (default)")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: objdump [flags] file...")
+		fmt.Fprintln(os.Stderr, "files ending in .vm are read as linked "+
+			"programs, anything else as objects")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if !(*headers || *sections || *symbols || *relocs || *disasm) {
+		*all = true
+	}
+
+	for _, fname := range flag.Args() {
+		b, err := ioutil.ReadFile(fname)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if filepath.Ext(fname) == ".vm" {
+			err = dumpProgram(os.Stdout, fname, b)
+		} else {
+			err = dumpObject(os.Stdout, fname, b)
+		}
+		if err != nil {
+			log.Fatalf("%s: %s", fname, err)
+		}
+	}
+}
+
+func dumpObject(w io.Writer, fname string, b []byte) error {
+	o, err := vm.ScanObject(b)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s: file format vm-object\n\n", fname)
+
+	if *all || *headers {
+		fmt.Fprintln(w, "Header:")
+		fmt.Fprintf(w, "  entry    %04x\n", o.Entry)
+		fmt.Fprintf(w, "  relocs   %04x size %d\n", o.RelAddr, o.RelSize)
+		fmt.Fprintf(w, "  symbols  %04x size %d\n", o.SymAddr, o.SymSize)
+		fmt.Fprintf(w, "  sections %04x size %d\n", o.SecAddr, o.SecSize)
+		fmt.Fprintf(w, "  lines    %04x size %d\n\n", o.LineAddr, o.LineSize)
+	}
+	if *all || *sections {
+		dumpSections(w, o.SecTab, o.SecTab)
+	}
+	if *all || *symbols {
+		fmt.Fprintln(w, "Symbol table:")
+		for i, s := range o.SymTab {
+			fmt.Fprintf(w, "  %3d %04x %-5s %-6s %s\n", i, s.Address(),
+				s.Section(), s.Binding(), s.Name())
+		}
+		fmt.Fprintln(w)
+	}
+	if *all || *relocs {
+		fmt.Fprintln(w, "Relocation records:")
+		fmt.Fprintln(w, "  SECTION OFFSET TYPE  SYMBOL")
+		for _, r := range o.RelocTab {
+			name := "?"
+			if int(r.Index()) < len(o.SymTab) {
+				name = o.SymTab[r.Index()].Name()
+			}
+			fmt.Fprintf(w, "  %-7s %04x   %-5s %s\n", r.Section(), r.Offset(),
+				r.Type(), r.Ref(name))
+		}
+		fmt.Fprintln(w)
+	}
+	if *all || *disasm {
+		m := new(vm.AddressMap)
+		for _, s := range o.SymTab {
+			if s.Section() == vm.TEXT {
+				m.Add(s.Name(), s.Address(), s.Len())
+			}
+		}
+		dumpText(w, o.Disassemble(), m, o.LineTab)
+	}
+	return nil
+}
+
+func dumpProgram(w io.Writer, fname string, b []byte) error {
+	p, err := vm.ScanProgram(b)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s: file format vm-program\n\n", fname)
+
+	if *all || *headers {
+		fmt.Fprintln(w, "Header:")
+		fmt.Fprintf(w, "  entry    %04x\n", p.Entry)
+		fmt.Fprintf(w, "  sections %04x size %d\n", p.SecOff, p.SecSize)
+		fmt.Fprintf(w, "  symbols  %04x size %d\n", p.SymOff, p.SymSize)
+		fmt.Fprintf(w, "  lines    %04x size %d\n", p.LineOff, p.LineSize)
+		sb, size := p.Stack()
+		fmt.Fprintf(w, "  stack    %04x size %d\n\n", sb, size)
+	}
+	if *all || *sections {
+		dumpSections(w, p.SecTab, p)
+	}
+	if *all || *symbols {
+		fmt.Fprintln(w, "Symbol table:")
+		for i, s := range p.SymTab {
+			fmt.Fprintf(w, "  %3d %04x %-5s %-6s %s\n", i,
+				p.Base(s.Section())+s.Address(), s.Section(),
+				s.Binding(), s.Name())
+		}
+		fmt.Fprintln(w)
+	}
+	if *all || *disasm {
+		m := p.AddressMap()
+		dumpText(w, vm.Disassemble(p.SecTab[vm.TEXT], p.Base(vm.TEXT), m), m,
+			p.Lines())
+	}
+	return nil
+}
+
+func dumpSections(w io.Writer, st vm.SectionTable, bases vm.Bases) {
+	fmt.Fprintln(w, "Sections:")
+	fmt.Fprintln(w, "  NAME BASE SIZE")
+	for i, sec := range st {
+		if cap(sec) > 0 {
+			fmt.Fprintf(w, "  %-4s %04x %d\n", vm.SecType(i),
+				bases.Base(vm.SecType(i)), len(sec))
+		}
+	}
+	fmt.Fprintln(w)
+
+	for i, sec := range st {
+		if len(sec) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "Contents of section %s:\n", vm.SecType(i))
+		base := bases.Base(vm.SecType(i))
+		for off := 0; off < len(sec); off += 16 {
+			end := off + 16
+			if end > len(sec) {
+				end = len(sec)
+			}
+			fmt.Fprintf(w, "  %04x ", int(base)+off)
+			for j := off; j < off+16; j++ {
+				if j < end {
+					fmt.Fprintf(w, " %02x", sec[j])
+				} else {
+					fmt.Fprint(w, "   ")
+				}
+			}
+			fmt.Fprint(w, "  ")
+			for _, c := range sec[off:end] {
+				if c < 0x20 || c > 0x7e {
+					c = '.'
+				}
+				fmt.Fprintf(w, "%c", c)
+			}
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func dumpText(w io.Writer, il []vm.Inst, m *vm.AddressMap, lines *vm.LineTable) {
+	fmt.Fprintln(w, "Disassembly of section text:")
+	last := ""
+	for _, i := range il {
+		if name, off, ok := m.Lookup(i.Addr); ok && off == 0 {
+			fmt.Fprintf(w, "\n%04x <%s>:\n", i.Addr, name)
+		}
+		if pos := lines.Position(i.Addr); *lineNums && pos != "" && pos != last {
+			fmt.Fprintf(w, "%s\n", pos)
+			last = pos
+		}
+		raw := ""
+		for _, b := range i.Bytes {
+			raw += fmt.Sprintf("%02x ", b)
+		}
+		fmt.Fprintf(w, "  %4x:  %-9s  %s\n", i.Addr, raw, i)
+	}
+	fmt.Fprintln(w)
+}
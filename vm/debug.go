@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rthornton128/vm/cpu"
+	vm "github.com/rthornton128/vm/lib"
+)
+
+// debugger is an interactive front end to the CPU. It reads commands, one
+// per line, and executes them against a CPU that has already been
+// initialised.
+type debugger struct {
+	cpu   *cpu.CPU
+	bp    map[uint16]bool // breakpoints
+	syms  *vm.AddressMap
+	lines *vm.LineTable
+	in    *bufio.Scanner
+	out   io.Writer
+	sig   chan os.Signal // interrupts the program while it runs
+}
+
+func newDebugger(c *cpu.CPU, syms *vm.AddressMap, lines *vm.LineTable,
+	in io.Reader, out io.Writer) *debugger {
+	return &debugger{
+		cpu:   c,
+		bp:    make(map[uint16]bool),
+		syms:  syms,
+		lines: lines,
+		in:    bufio.NewScanner(in),
+		out:   out,
+		sig:   make(chan os.Signal, 1),
+	}
+}
+
+type command struct {
+	name, alias, args, help string
+	fn                      func(d *debugger, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"break", "b", "[addr|sym]", "set a breakpoint or list breakpoints", (*debugger).cmdBreak},
+		{"clear", "", "addr|sym", "delete a breakpoint", (*debugger).cmdClear},
+		{"continue", "c", "", "run until a breakpoint or the program ends", (*debugger).cmdContinue},
+		{"step", "s", "", "execute one instruction", (*debugger).cmdStep},
+		{"next", "n", "", "execute one instruction, stepping over calls", (*debugger).cmdNext},
+		{"regs", "r", "", "print registers and flags", (*debugger).cmdRegs},
+		{"set", "", "reg value", "set register a, b, c, pc, sp or flags", (*debugger).cmdSet},
+		{"x", "", "addr|sym [n]", "examine n bytes of memory", (*debugger).cmdExamine},
+		{"write", "w", "addr|sym byte...", "write bytes to memory", (*debugger).cmdWrite},
+		{"list", "l", "[addr|sym] [n]", "disassemble n instructions", (*debugger).cmdList},
+		{"symbols", "", "", "list known symbols", (*debugger).cmdSymbols},
+		{"help", "h", "", "print this help", (*debugger).cmdHelp},
+		{"quit", "q", "", "exit the debugger", nil},
+	}
+}
+
+// lookup finds the command matching name, its alias or any unambiguous
+// prefix of its name
+func lookup(name string) (*command, error) {
+	var found *command
+	for i, c := range commands {
+		if c.name == name || c.alias == name {
+			return &commands[i], nil
+		}
+		if strings.HasPrefix(c.name, name) {
+			if found != nil {
+				return nil, fmt.Errorf("ambiguous command: %s", name)
+			}
+			found = &commands[i]
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("unknown command: %s", name)
+	}
+	return found, nil
+}
+
+func (d *debugger) run() {
+	d.where()
+	for {
+		fmt.Fprint(d.out, "(vmdbg) ")
+		if !d.in.Scan() {
+			fmt.Fprintln(d.out)
+			return
+		}
+		fields := strings.Fields(d.in.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		cmd, err := lookup(fields[0])
+		if err != nil {
+			fmt.Fprintln(d.out, err)
+			continue
+		}
+		if cmd.fn == nil {
+			return
+		}
+		if err := d.exec(cmd, fields[1:]); err != nil {
+			fmt.Fprintln(d.out, "error:", err)
+		}
+	}
+}
+
+func (d *debugger) exec(cmd *command, args []string) error {
+	return cmd.fn(d, args)
+}
+
+// address parses an address, which may be a symbol name, a symbol name
+// plus an offset or an integer literal
+func (d *debugger) address(s string) (uint16, error) {
+	name, off := s, ""
+	if i := strings.IndexByte(s, '+'); i > 0 {
+		name, off = s[:i], s[i+1:]
+	}
+	if addr, ok := d.syms.Address(name); ok {
+		if off == "" {
+			return addr, nil
+		}
+		n, err := strconv.ParseUint(off, 0, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid offset: %s", off)
+		}
+		return addr + uint16(n), nil
+	}
+	n, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid address or unknown symbol: %s", s)
+	}
+	return uint16(n), nil
+}
+
+// disasm decodes the instruction at addr
+func (d *debugger) disasm(addr uint16) vm.Inst {
+	return cpu.DecodeAt(d.cpu.Memory(), addr, d.syms)
+}
+
+func (d *debugger) where() {
+	if d.cpu.Stopped() {
+		if f := d.cpu.Fault(); f != nil {
+			f.Report(d.out, d.syms, d.lines, d.cpu.Memory())
+			return
+		}
+		fmt.Fprintf(d.out, "program %s with exit code %d\n", d.cpu.Reason(),
+			d.cpu.ExitCode())
+		return
+	}
+	fmt.Fprintf(d.out, "%04x <%s>: %s", d.cpu.PC(), d.syms.Name(d.cpu.PC()),
+		d.disasm(d.cpu.PC()))
+	if pos := d.lines.Position(d.cpu.PC()); pos != "" {
+		fmt.Fprintf(d.out, " at %s", pos)
+	}
+	fmt.Fprintln(d.out)
+}
+
+// until runs the CPU until it reaches a breakpoint, the program ends, stop
+// returns true, the cycle limit is reached or the program is interrupted
+// with SIGINT. At least one instruction is always executed.
+func (d *debugger) until(stop func() bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signal.Notify(d.sig, os.Interrupt)
+	defer signal.Stop(d.sig)
+	go func() {
+		select {
+		case <-d.sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		// a budget of one step keeps the clock and cycle limit in effect
+		err := d.cpu.Run(ctx, 1)
+		if err != nil && err != cpu.ErrBudget {
+			// faults are reported by where
+			if err == context.Canceled {
+				fmt.Fprintln(d.out, "interrupted")
+			} else if !d.cpu.Stopped() {
+				fmt.Fprintln(d.out, err)
+			}
+			break
+		}
+		if d.cpu.Stopped() || d.bp[d.cpu.PC()] || stop() {
+			break
+		}
+	}
+	d.where()
+}
+
+func (d *debugger) running() error {
+	if d.cpu.Stopped() {
+		return fmt.Errorf("program is not running")
+	}
+	return nil
+}
+
+func (d *debugger) cmdBreak(args []string) error {
+	if len(args) == 0 {
+		addrs := make([]int, 0, len(d.bp))
+		for a := range d.bp {
+			addrs = append(addrs, int(a))
+		}
+		sort.Ints(addrs)
+		for _, a := range addrs {
+			fmt.Fprintf(d.out, "%04x <%s>\n", a, d.syms.Name(uint16(a)))
+		}
+		return nil
+	}
+	addr, err := d.address(args[0])
+	if err != nil {
+		return err
+	}
+	d.bp[addr] = true
+	fmt.Fprintf(d.out, "breakpoint at %04x <%s>\n", addr, d.syms.Name(addr))
+	return nil
+}
+
+func (d *debugger) cmdClear(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: clear addr|sym")
+	}
+	addr, err := d.address(args[0])
+	if err != nil {
+		return err
+	}
+	if !d.bp[addr] {
+		return fmt.Errorf("no breakpoint at %04x", addr)
+	}
+	delete(d.bp, addr)
+	return nil
+}
+
+func (d *debugger) cmdContinue(args []string) error {
+	if err := d.running(); err != nil {
+		return err
+	}
+	d.until(func() bool { return false })
+	return nil
+}
+
+func (d *debugger) cmdStep(args []string) error {
+	if err := d.running(); err != nil {
+		return err
+	}
+	d.until(func() bool { return true })
+	return nil
+}
+
+func (d *debugger) cmdNext(args []string) error {
+	if err := d.running(); err != nil {
+		return err
+	}
+	if d.disasm(d.cpu.PC()).Op != vm.CALL {
+		return d.cmdStep(args)
+	}
+	// run until the call returns to the following instruction with the
+	// stack as it is now, so recursive calls are stepped over too
+	ret, sp := d.cpu.PC()+3, d.cpu.SP()
+	d.until(func() bool { return d.cpu.PC() == ret && d.cpu.SP() == sp })
+	return nil
+}
+
+func (d *debugger) cmdRegs(args []string) error {
+	r := d.cpu.Regs()
+	fmt.Fprintf(d.out, "a  %02x  b  %02x  c  %02x  flags %s\n", r.AC, r.B, r.C, r.Flags)
+	fmt.Fprintf(d.out, "pc %04x <%s>  sp %04x\n", r.PC, d.syms.Name(r.PC), r.SP)
+	ie := "disabled"
+	if r.IE {
+		ie = "enabled"
+	}
+	fmt.Fprintf(d.out, "interrupts %s  vectors %04x  pending %08b\n", ie,
+		r.Vectors, d.cpu.Interrupts().Pending())
+	fmt.Fprintf(d.out, "cycles %d\n", d.cpu.Cycles())
+	return nil
+}
+
+func (d *debugger) cmdSet(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: set reg value")
+	}
+	n, err := strconv.ParseUint(args[1], 0, 16)
+	if err != nil {
+		return err
+	}
+	c := d.cpu
+	switch args[0] {
+	case "a":
+		c.SetA(byte(n))
+	case "b":
+		c.SetB(byte(n))
+	case "c":
+		c.SetC(byte(n))
+	case "pc":
+		c.SetPC(uint16(n))
+	case "sp":
+		c.SetSP(uint16(n))
+	case "flags":
+		c.SetFlags(cpu.Flags(n))
+	default:
+		return fmt.Errorf("unknown register: %s", args[0])
+	}
+	return nil
+}
+
+func (d *debugger) cmdExamine(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: x addr|sym [n]")
+	}
+	addr, err := d.address(args[0])
+	if err != nil {
+		return err
+	}
+	n := uint64(16)
+	if len(args) == 2 {
+		if n, err = strconv.ParseUint(args[1], 0, 16); err != nil {
+			return err
+		}
+	}
+	for i := uint64(0); i < n; i++ {
+		if i%16 == 0 {
+			if i > 0 {
+				fmt.Fprintln(d.out)
+			}
+			fmt.Fprintf(d.out, "%04x:", addr)
+		}
+		b, err := d.cpu.Read(addr)
+		if err != nil {
+			fmt.Fprintln(d.out)
+			return err
+		}
+		fmt.Fprintf(d.out, " %02x", b)
+		addr++
+	}
+	fmt.Fprintln(d.out)
+	return nil
+}
+
+func (d *debugger) cmdWrite(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: write addr|sym byte...")
+	}
+	addr, err := d.address(args[0])
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 0, len(args)-1)
+	for _, a := range args[1:] {
+		n, err := strconv.ParseUint(a, 0, 8)
+		if err != nil {
+			return err
+		}
+		data = append(data, byte(n))
+	}
+	for i, b := range data {
+		if err := d.cpu.Write(addr+uint16(i), b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *debugger) cmdList(args []string) error {
+	addr, n := d.cpu.PC(), uint64(8)
+	var err error
+	if len(args) > 0 {
+		if addr, err = d.address(args[0]); err != nil {
+			return err
+		}
+	}
+	if len(args) > 1 {
+		if n, err = strconv.ParseUint(args[1], 0, 16); err != nil {
+			return err
+		}
+	}
+	last := ""
+	for i := uint64(0); i < n; i++ {
+		if name, off, ok := d.syms.Lookup(addr); ok && off == 0 {
+			fmt.Fprintf(d.out, "%s:\n", name)
+		}
+		mark := "  "
+		if addr == d.cpu.PC() {
+			mark = "=>"
+		} else if d.bp[addr] {
+			mark = " *"
+		}
+		i := d.disasm(addr)
+		fmt.Fprintf(d.out, "%s %04x  %s", mark, addr, i)
+		if pos := d.lines.Position(addr); pos != "" && pos != last {
+			pad := 15 - len(i.String())
+			if pad < 1 {
+				pad = 1
+			}
+			fmt.Fprintf(d.out, "%*s; %s", pad, "", pos)
+			last = pos
+		}
+		fmt.Fprintln(d.out)
+		addr += uint16(len(i.Bytes))
+	}
+	return nil
+}
+
+func (d *debugger) cmdSymbols(args []string) error {
+	for _, n := range d.syms.Symbols() {
+		addr, _ := d.syms.Address(n)
+		fmt.Fprintf(d.out, "%04x %s\n", addr, n)
+	}
+	return nil
+}
+
+func (d *debugger) cmdHelp(args []string) error {
+	for _, c := range commands {
+		name := c.name
+		if c.alias != "" {
+			name += ", " + c.alias
+		}
+		fmt.Fprintf(d.out, "%-11s %-18s %s\n", name, c.args, c.help)
+	}
+	fmt.Fprintln(d.out, "commands may be abbreviated to any unique prefix")
+	return nil
+}
+
+// debug runs the CPU under the interactive debugger on the terminal
+func debug(c *cpu.CPU, syms *vm.AddressMap, lines *vm.LineTable) {
+	newDebugger(c, syms, lines, os.Stdin, os.Stdout).run()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"go/token"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rthornton128/vm/cpu"
+	vm "github.com/rthornton128/vm/lib"
+)
+
+// down recurses until the accumulator, decremented on each call, reaches
+// zero
+const down = `.text
+main:
+mvi 1
+mvr %b
+mvi 3
+call $down
+mvi 7
+ret
+down:
+jpz $done
+sub %b
+call $down
+done:
+ret
+.data
+buf: .byte 0, 0, 0, 0
+`
+
+// load assembles and links src into a program and returns it with a CPU
+// ready to run it
+func load(t *testing.T, src string) (*cpu.CPU, *vm.Program) {
+	fset := token.NewFileSet()
+	f := fset.AddFile("test.a", -1, len(src))
+	b := new(bytes.Buffer)
+	if err := vm.NewEncoder(f, b).Encode(strings.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	ob, err := vm.ScanObject(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := vm.NewObject()
+	if err := o.Merge(ob); err != nil {
+		t.Fatal(err)
+	}
+	p := vm.NewProgram(o)
+	c, err := cpu.New(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, p
+}
+
+func TestDebugger(t *testing.T) {
+	c, p := load(t, down)
+	script := `break down
+continue
+step
+step
+regs
+clear down
+next
+regs
+next
+write buf 1 2 0x03
+x buf 4
+x buf+1 2
+b
+continue
+step
+bogus
+`
+	expect := `0000 <main>: mvi 1 at test.a:3
+(vmdbg) breakpoint at 000b <down>
+(vmdbg) 000b <down>: jpz $done at test.a:10
+(vmdbg) 000e <down+3>: sub %b at test.a:11
+(vmdbg) 000f <down+4>: call $down at test.a:12
+(vmdbg) a  02  b  01  c  00  flags -----
+pc 000f <down+4>  sp 001b
+interrupts disabled  vectors 0000  pending 00000000
+cycles 50
+(vmdbg) (vmdbg) 0012 <done>: ret at test.a:14
+(vmdbg) a  00  b  01  c  00  flags z----
+pc 0012 <done>  sp 001b
+interrupts disabled  vectors 0000  pending 00000000
+cycles 169
+(vmdbg) 0008 <main+8>: mvi 7 at test.a:7
+(vmdbg) (vmdbg) 0013: 01 02 03 00
+(vmdbg) 0014: 02 03
+(vmdbg) (vmdbg) program returned with exit code 7
+(vmdbg) error: program is not running
+(vmdbg) unknown command: bogus
+` + "(vmdbg) \n"
+	out := new(bytes.Buffer)
+	newDebugger(c, p.AddressMap(), p.Lines(), strings.NewReader(script), out).run()
+	if out.String() != expect {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expect, out)
+	}
+}
+
+func TestDebuggerNext(t *testing.T) {
+	c, p := load(t, down)
+	out := new(bytes.Buffer)
+	d := newDebugger(c, p.AddressMap(), p.Lines(), strings.NewReader(""), out)
+	for _, line := range []string{"n", "n", "n", "break done", "next"} {
+		f := strings.Fields(line)
+		cmd, err := lookup(f[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.exec(cmd, f[1:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// next stops at a breakpoint reached in a deeper call, here the
+	// innermost of the four
+	if c.PC() != 0x12 || c.SP() != 0x21 {
+		t.Fatalf("expected breakpoint at 0012 with sp 0021, got %04x sp %04x",
+			c.PC(), c.SP())
+	}
+}
+
+func TestDebuggerStop(t *testing.T) {
+	const loop = ".text\nmain:\njmp $main\n"
+	c, p := load(t, loop)
+	c.SetCycleLimit(100)
+	out := new(bytes.Buffer)
+	d := newDebugger(c, p.AddressMap(), p.Lines(), strings.NewReader("c\nc\n"), out)
+	d.run()
+	expect := "cycle limit reached\n0000 <main>: jmp $main at test.a:3\n"
+	if strings.Count(out.String(), expect) != 2 || c.Cycles() != 100 {
+		t.Fatalf("expected continue to stop at the cycle limit, got %d cycles:\n%s",
+			c.Cycles(), out)
+	}
+
+	// an interrupt stops the program without ending the session
+	c, p = load(t, loop)
+	out.Reset()
+	d = newDebugger(c, p.AddressMap(), p.Lines(), strings.NewReader("c\n"), out)
+	d.sig <- os.Interrupt
+	d.run()
+	if !strings.Contains(out.String(), "interrupted\n0000 <main>:") || c.Stopped() {
+		t.Fatal("expected continue to be interrupted, got", out)
+	}
+}
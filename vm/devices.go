@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rthornton128/vm/cpu"
+)
+
+// newDevice returns the device called name for mapping onto the bus, with
+// the console reading from in
+func newDevice(name string, seed int64, in io.Reader) (cpu.Device, error) {
+	switch name {
+	case "console":
+		return cpu.NewConsole(in, os.Stdout), nil
+	case "timer":
+		return new(cpu.Timer), nil
+	case "random":
+		return cpu.NewRandom(seed), nil
+	}
+	return nil, fmt.Errorf("unknown device: %s", name)
+}
+
+// mapDevices maps the devices described by spec onto b. The spec is a
+// comma separated list of name=address pairs, for example
+// "console=0xff00,timer=0xff04:1". An address may be followed by the
+// interrupt line the device raises on irq. newDevice supplies the device
+// for a name.
+func mapDevices(b *cpu.Bus, spec string, irq *cpu.Interrupts,
+	newDevice func(name string) (cpu.Device, error)) error {
+	if spec == "" {
+		return nil
+	}
+	for _, field := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid device %q, expected name=address", field)
+		}
+		loc := strings.SplitN(kv[1], ":", 2)
+		addr, err := strconv.ParseUint(loc[0], 0, 16)
+		if err != nil {
+			return fmt.Errorf("invalid address for %s: %s", kv[0], loc[0])
+		}
+		dev, err := newDevice(kv[0])
+		if err != nil {
+			return err
+		}
+		if len(loc) == 2 {
+			line, err := strconv.ParseUint(loc[1], 0, 8)
+			if err != nil || line >= cpu.NumIRQ {
+				return fmt.Errorf("invalid interrupt line for %s: %s", kv[0], loc[1])
+			}
+			d, ok := dev.(cpu.Interrupter)
+			if !ok {
+				return fmt.Errorf("%s: device does not raise interrupts", kv[0])
+			}
+			d.Connect(func() { irq.Raise(int(line)) })
+		}
+		if err := b.Map(kv[0], uint16(addr), dev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/rthornton128/vm/cpu"
+	vm "github.com/rthornton128/vm/lib"
+)
+
+// profiler counts the instructions and cycles executed at each address and
+// in each call stack, which is tracked from calls, returns and interrupts
+type profiler struct {
+	syms    *vm.AddressMap
+	lines   *vm.LineTable
+	start   time.Time
+	last    uint64   // cycles at the previous step
+	stack   []uint16 // call sites of the active calls, innermost last
+	samples map[string]*sample
+	addrs   map[uint16]*addrStat
+	calls   map[string]int
+}
+
+// sample is the count of instructions and cycles executed in a call stack
+type sample struct {
+	stack  []uint16 // address executed followed by the call sites
+	insts  int64
+	cycles int64
+}
+
+type addrStat struct {
+	inst   string
+	insts  int64
+	cycles int64
+}
+
+func newProfiler(syms *vm.AddressMap, lines *vm.LineTable) *profiler {
+	return &profiler{
+		syms:    syms,
+		lines:   lines,
+		start:   time.Now(),
+		samples: make(map[string]*sample),
+		addrs:   make(map[uint16]*addrStat),
+		calls:   make(map[string]int),
+	}
+}
+
+// function returns the name of the function containing addr
+func (p *profiler) function(addr uint16) string {
+	if name, _, ok := p.syms.Lookup(addr); ok {
+		return name
+	}
+	return "??"
+}
+
+func (p *profiler) record(tr *cpu.Trace) {
+	cycles := int64(tr.Cycles - p.last)
+	p.last = tr.Cycles
+
+	var insts int64
+	var op vm.Opcode
+	if tr.Inst != nil {
+		insts = 1
+		op = vm.Opcode(tr.Inst[0] & 0x3f)
+	}
+
+	stack := make([]uint16, 0, len(p.stack)+1)
+	stack = append(stack, tr.PC)
+	for i := len(p.stack) - 1; i >= 0; i-- {
+		stack = append(stack, p.stack[i])
+	}
+	key := fmt.Sprint(stack)
+	s, ok := p.samples[key]
+	if !ok {
+		s = &sample{stack: stack}
+		p.samples[key] = s
+	}
+	s.insts += insts
+	s.cycles += cycles
+
+	a, ok := p.addrs[tr.PC]
+	if !ok {
+		a = &addrStat{inst: "(wait)"}
+		if tr.Inst != nil {
+			i, _ := vm.Decode(tr.Inst, tr.PC)
+			if i.Op.Operands() == 2 && !i.Illegal {
+				if _, _, ok := p.syms.Lookup(i.Operand); ok {
+					i.Symbol = p.syms.Name(i.Operand)
+				}
+			}
+			a.inst = i.String()
+		}
+		p.addrs[tr.PC] = a
+	}
+	a.insts += insts
+	a.cycles += cycles
+
+	switch op {
+	case vm.CALL:
+		if tr.Inst != nil && len(tr.Inst) == 3 {
+			p.calls[p.function(uint16(tr.Inst[1])<<8|uint16(tr.Inst[2]))]++
+			p.stack = append(p.stack, tr.PC)
+		}
+	case vm.RET, vm.RETI:
+		if len(p.stack) > 0 {
+			p.stack = p.stack[:len(p.stack)-1]
+		}
+	}
+	if tr.IRQ >= 0 {
+		p.calls[p.function(tr.Regs.PC)]++
+		p.stack = append(p.stack, tr.PC)
+	}
+}
+
+type funcStat struct {
+	name      string
+	insts     int64
+	flat, cum int64 // cycles
+	calls     int
+}
+
+// functions aggregates the samples by function, ordered by the cycles
+// spent in each
+func (p *profiler) functions() ([]*funcStat, int64) {
+	stats := make(map[string]*funcStat)
+	get := func(name string) *funcStat {
+		f, ok := stats[name]
+		if !ok {
+			f = &funcStat{name: name, calls: p.calls[name]}
+			stats[name] = f
+		}
+		return f
+	}
+	var total int64
+	for _, s := range p.samples {
+		total += s.cycles
+		f := get(p.function(s.stack[0]))
+		f.flat += s.cycles
+		f.insts += s.insts
+		// count cumulative time once per function, however deeply recursive
+		seen := make(map[string]bool)
+		for _, addr := range s.stack {
+			name := p.function(addr)
+			if !seen[name] {
+				seen[name] = true
+				get(name).cum += s.cycles
+			}
+		}
+	}
+	list := make([]*funcStat, 0, len(stats))
+	for _, f := range stats {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].flat != list[j].flat {
+			return list[i].flat > list[j].flat
+		}
+		return list[i].name < list[j].name
+	})
+	return list, total
+}
+
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+// report writes the time spent in each function and at the hottest
+// addresses as text
+func (p *profiler) report(w io.Writer) {
+	funcs, total := p.functions()
+	fmt.Fprintf(w, "Total: %d cycles\n\n", total)
+	fmt.Fprintf(w, "%10s %6s %10s %6s %8s %6s  %s\n", "flat", "flat%", "cum",
+		"cum%", "insts", "calls", "function")
+	for _, f := range funcs {
+		fmt.Fprintf(w, "%10d %5.1f%% %10d %5.1f%% %8d %6d  %s\n", f.flat,
+			percent(f.flat, total), f.cum, percent(f.cum, total), f.insts,
+			f.calls, f.name)
+	}
+
+	addrs := make([]uint16, 0, len(p.addrs))
+	for addr := range p.addrs {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		a, b := p.addrs[addrs[i]], p.addrs[addrs[j]]
+		if a.cycles != b.cycles {
+			return a.cycles > b.cycles
+		}
+		return addrs[i] < addrs[j]
+	})
+	if len(addrs) > 20 {
+		addrs = addrs[:20]
+	}
+	fmt.Fprintf(w, "\nHottest instructions:\n")
+	fmt.Fprintf(w, "%10s %6s %8s  %s\n", "cycles", "%", "insts", "address")
+	for _, addr := range addrs {
+		a := p.addrs[addr]
+		fmt.Fprintf(w, "%10d %5.1f%% %8d  %04x <%s> %s\n", a.cycles,
+			percent(a.cycles, total), a.insts, addr, p.syms.Name(addr), a.inst)
+	}
+}
+
+// writePprof writes the samples as a gzip compressed profile in the
+// protocol buffer format read by go tool pprof. Addresses without a source
+// line are reported at line 0 of a file named after the program.
+func (p *profiler) writePprof(w io.Writer, program string) error {
+	strs := map[string]int64{"": 0}
+	table := []string{""}
+	str := func(s string) int64 {
+		if i, ok := strs[s]; ok {
+			return i
+		}
+		strs[s] = int64(len(table))
+		table = append(table, s)
+		return strs[s]
+	}
+
+	var prof pbuf
+	valueType := func(field int, typ, unit string) {
+		var v pbuf
+		v.int64(1, str(typ))
+		v.int64(2, str(unit))
+		prof.bytes(field, v.b)
+	}
+	valueType(1, "instructions", "count")
+	valueType(1, "cycles", "count")
+
+	keys := make([]string, 0, len(p.samples))
+	for k := range p.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	locs := make(map[uint16]uint64)
+	var order []uint16
+	for _, k := range keys {
+		s := p.samples[k]
+		ids := make([]uint64, len(s.stack))
+		for i, addr := range s.stack {
+			if _, ok := locs[addr]; !ok {
+				locs[addr] = uint64(len(locs) + 1)
+				order = append(order, addr)
+			}
+			ids[i] = locs[addr]
+		}
+		var sm pbuf
+		sm.packed(1, ids)
+		sm.packed(2, []uint64{uint64(s.insts), uint64(s.cycles)})
+		prof.bytes(2, sm.b)
+	}
+
+	funcs := make(map[string]uint64)
+	files := make(map[string]string)
+	var names []string
+	for _, addr := range order {
+		name := p.function(addr)
+		file, n, ok := p.lines.Lookup(addr)
+		if !ok {
+			file = program
+		}
+		if _, ok := funcs[name]; !ok {
+			funcs[name] = uint64(len(funcs) + 1)
+			files[name] = file
+			names = append(names, name)
+		}
+		var line, loc pbuf
+		line.uint64(1, funcs[name])
+		line.int64(2, int64(n))
+		loc.uint64(1, locs[addr])
+		loc.uint64(3, uint64(addr))
+		loc.bytes(4, line.b)
+		prof.bytes(4, loc.b)
+	}
+	for _, name := range names {
+		var fn pbuf
+		fn.uint64(1, funcs[name])
+		fn.int64(2, str(name))
+		fn.int64(3, str(name))
+		fn.int64(4, str(files[name]))
+		prof.bytes(5, fn.b)
+	}
+
+	// the string table must be complete before it is written
+	dur := time.Since(p.start)
+	valueType(11, "cycles", "count")
+	prof.int64(12, 1)
+	prof.int64(9, p.start.UnixNano())
+	prof.int64(10, int64(dur))
+	for _, s := range table {
+		prof.str(6, s)
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(prof.b); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// pbuf encodes protocol buffer messages, just enough for the pprof format
+type pbuf struct {
+	b []byte
+}
+
+func (p *pbuf) varint(x uint64) {
+	for x >= 0x80 {
+		p.b = append(p.b, byte(x)|0x80)
+		x >>= 7
+	}
+	p.b = append(p.b, byte(x))
+}
+
+func (p *pbuf) key(field, wire int) {
+	p.varint(uint64(field<<3 | wire))
+}
+
+func (p *pbuf) uint64(field int, x uint64) {
+	p.key(field, 0)
+	p.varint(x)
+}
+
+func (p *pbuf) int64(field int, x int64) {
+	p.uint64(field, uint64(x))
+}
+
+func (p *pbuf) bytes(field int, b []byte) {
+	p.key(field, 2)
+	p.varint(uint64(len(b)))
+	p.b = append(p.b, b...)
+}
+
+func (p *pbuf) str(field int, s string) {
+	p.bytes(field, []byte(s))
+}
+
+func (p *pbuf) packed(field int, xs []uint64) {
+	var v pbuf
+	for _, x := range xs {
+		v.varint(x)
+	}
+	p.bytes(field, v.b)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/rthornton128/vm/cpu"
+)
+
+// profile runs the down program under the profiler
+func profile(t *testing.T) *profiler {
+	c, p := load(t, down)
+	prof := newProfiler(p.AddressMap(), p.Lines())
+	c.SetTracer(prof.record)
+	if err := c.Run(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	return prof
+}
+
+func TestProfileStack(t *testing.T) {
+	p := profile(t)
+	if len(p.stack) != 0 {
+		t.Fatal("expected empty call stack, got", p.stack)
+	}
+	// samples are keyed by the address executed followed by the call
+	// sites, innermost first
+	var tests = []struct {
+		stack         string
+		insts, cycles int64
+	}{
+		{"[10]", 1, 10},
+		{"[15 5]", 1, 17},
+		{"[11 15 15 15 5]", 1, 10},
+		{"[18 15 15 15 5]", 1, 10},
+		{"[18 5]", 1, 10},
+	}
+	for _, test := range tests {
+		s, ok := p.samples[test.stack]
+		if !ok {
+			t.Fatal("expected sample for stack", test.stack)
+		}
+		if s.insts != test.insts || s.cycles != test.cycles {
+			t.Fatalf("%s: expected %d insts and %d cycles, got %d and %d",
+				test.stack, test.insts, test.cycles, s.insts, s.cycles)
+		}
+	}
+	if p.calls["down"] != 4 || p.calls["main"] != 0 {
+		t.Fatal("expected 4 calls to down, got", p.calls)
+	}
+
+	// an interrupt is tracked as a call from the interrupted instruction
+	// until reti
+	p.record(&cpu.Trace{PC: 0x8, Inst: []byte{0x08, 0x07}, IRQ: 1,
+		Regs: cpu.Regs{PC: 0xb}, Cycles: p.last + 7 + 13})
+	p.record(&cpu.Trace{PC: 0xb, Inst: []byte{0x02, 0x00, 0x12}, IRQ: -1,
+		Cycles: p.last + 10})
+	if s := p.samples["[11 8]"]; s == nil || s.cycles != 10 {
+		t.Fatal("expected sample in handler called from 0008, got", s)
+	}
+	if p.calls["down"] != 5 {
+		t.Fatal("expected interrupt to count as a call, got", p.calls)
+	}
+	p.record(&cpu.Trace{PC: 0x12, Inst: []byte{0x2b}, IRQ: -1,
+		Cycles: p.last + 10})
+	if len(p.stack) != 0 {
+		t.Fatal("expected reti to return from interrupt, got", p.stack)
+	}
+}
+
+func TestProfileReport(t *testing.T) {
+	expect := `Total: 196 cycles
+
+      flat  flat%        cum   cum%    insts  calls  function
+       103  52.6%        133  67.9%       10      4  down
+        53  27.0%        196 100.0%        6      0  main
+        40  20.4%         40  20.4%        4      0  done
+
+Hottest instructions:
+    cycles      %    insts  address
+        51  26.0%        3  000f <down+4> call $down
+        40  20.4%        4  000b <down> jpz $done
+        40  20.4%        4  0012 <done> ret
+        17   8.7%        1  0005 <main+5> call $down
+        12   6.1%        3  000e <down+3> sub %b
+        10   5.1%        1  000a <main+10> ret
+         7   3.6%        1  0000 <main> mvi 1
+         7   3.6%        1  0003 <main+3> mvi 3
+         7   3.6%        1  0008 <main+8> mvi 7
+         5   2.6%        1  0002 <main+2> mvr %b
+`
+	b := new(bytes.Buffer)
+	profile(t).report(b)
+	if b.String() != expect {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expect, b)
+	}
+}
+
+// field is a protocol buffer field, holding either a varint or bytes
+type field struct {
+	num int
+	x   uint64
+	b   []byte
+}
+
+// uvarint decodes a varint from the start of b, returning the rest of b
+func uvarint(t *testing.T, b []byte) (uint64, []byte) {
+	var x uint64
+	for i, c := range b {
+		x |= uint64(c&0x7f) << (7 * uint(i))
+		if c < 0x80 {
+			return x, b[i+1:]
+		}
+	}
+	t.Fatal("truncated varint")
+	return 0, nil
+}
+
+// fields decodes the fields of a protocol buffer message
+func fields(t *testing.T, b []byte) []field {
+	var fs []field
+	for len(b) > 0 {
+		var k, n uint64
+		k, b = uvarint(t, b)
+		f := field{num: int(k >> 3)}
+		switch k & 7 {
+		case 0:
+			f.x, b = uvarint(t, b)
+		case 2:
+			n, b = uvarint(t, b)
+			if uint64(len(b)) < n {
+				t.Fatal("truncated field", f.num)
+			}
+			f.b, b = b[:n], b[n:]
+		default:
+			t.Fatal("unexpected wire type", k&7)
+		}
+		fs = append(fs, f)
+	}
+	return fs
+}
+
+// packed decodes a packed repeated varint field
+func packed(t *testing.T, b []byte) []uint64 {
+	var xs []uint64
+	for len(b) > 0 {
+		var x uint64
+		x, b = uvarint(t, b)
+		xs = append(xs, x)
+	}
+	return xs
+}
+
+func TestWritePprof(t *testing.T) {
+	p := profile(t)
+	b := new(bytes.Buffer)
+	if err := p.writePprof(b, "down.vm"); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var strs []string
+	var types, samples, locs, funcs [][]byte
+	for _, f := range fields(t, data) {
+		switch f.num {
+		case 1:
+			types = append(types, f.b)
+		case 2:
+			samples = append(samples, f.b)
+		case 4:
+			locs = append(locs, f.b)
+		case 5:
+			funcs = append(funcs, f.b)
+		case 6:
+			strs = append(strs, string(f.b))
+		}
+	}
+	if len(strs) == 0 || strs[0] != "" {
+		t.Fatal("expected string table to start with the empty string")
+	}
+	var names []string
+	for _, b := range types {
+		fs := fields(t, b)
+		names = append(names, strs[fs[0].x]+"/"+strs[fs[1].x])
+	}
+	if s := fmt.Sprint(names); s != "[instructions/count cycles/count]" {
+		t.Fatal("expected instructions and cycles sample types, got", s)
+	}
+
+	// function id to name and file
+	fn := make(map[uint64]string)
+	for _, b := range funcs {
+		fs := fields(t, b)
+		fn[fs[0].x] = strs[fs[1].x] + " " + strs[fs[3].x]
+	}
+	// location id to address, function and line
+	loc := make(map[uint64]string)
+	for _, b := range locs {
+		fs := fields(t, b)
+		line := fields(t, fs[2].b)
+		loc[fs[0].x] = fmt.Sprintf("%04x %s:%d", fs[1].x, fn[line[0].x], line[1].x)
+	}
+
+	var insts, cycles uint64
+	found := false
+	for _, b := range samples {
+		fs := fields(t, b)
+		var stack []string
+		for _, id := range packed(t, fs[0].b) {
+			stack = append(stack, loc[id])
+		}
+		v := packed(t, fs[1].b)
+		insts += v[0]
+		cycles += v[1]
+		if fmt.Sprint(stack) == "[0012 done test.a:14 000f down test.a:12 "+
+			"000f down test.a:12 000f down test.a:12 0005 main test.a:6]" {
+			found = true
+		}
+	}
+	if insts != 20 || cycles != 196 {
+		t.Fatal("expected 20 instructions and 196 cycles, got", insts, cycles)
+	}
+	if !found {
+		t.Fatal("expected sample for the innermost ret")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/rthornton128/vm/cpu"
+	vm "github.com/rthornton128/vm/lib"
+)
+
+// tracer writes a line for each instruction the CPU executes, either as
+// text or as a JSON object per line for comparing runs with other tools
+type tracer struct {
+	w      *bufio.Writer
+	syms   *vm.AddressMap
+	lines  *vm.LineTable
+	json   bool
+	filter *traceFilter // nil to trace everything
+}
+
+func newTracer(w io.Writer, syms *vm.AddressMap, lines *vm.LineTable, json bool,
+	f *traceFilter) *tracer {
+	return &tracer{w: bufio.NewWriter(w), syms: syms, lines: lines, json: json,
+		filter: f}
+}
+
+// traceRecord is the JSON form of a trace line
+type traceRecord struct {
+	PC     uint16       `json:"pc"`
+	Sym    string       `json:"sym"`
+	Src    string       `json:"src,omitempty"`
+	Inst   string       `json:"inst"`
+	Bytes  string       `json:"bytes"`
+	A      byte         `json:"a"`
+	B      byte         `json:"b"`
+	C      byte         `json:"c"`
+	SP     uint16       `json:"sp"`
+	Flags  string       `json:"flags"`
+	Cycles uint64       `json:"cycles"`
+	Writes []traceWrite `json:"writes,omitempty"`
+	IRQ    *int         `json:"irq,omitempty"`
+}
+
+type traceWrite struct {
+	Addr  uint16 `json:"addr"`
+	Value byte   `json:"value"`
+}
+
+func (t *tracer) trace(tr *cpu.Trace) {
+	if t.filter != nil && !t.filter.match(tr.PC, t.syms) {
+		return
+	}
+	inst := "(wait)"
+	if tr.Inst != nil {
+		i, _ := vm.Decode(tr.Inst, tr.PC)
+		if i.Op.Operands() == 2 && !i.Illegal {
+			if _, _, ok := t.syms.Lookup(i.Operand); ok {
+				i.Symbol = t.syms.Name(i.Operand)
+			}
+		}
+		inst = i.String()
+	}
+	r := tr.Regs
+	src := t.lines.Position(tr.PC)
+
+	if t.json {
+		rec := traceRecord{PC: tr.PC, Sym: t.syms.Name(tr.PC), Src: src, Inst: inst,
+			Bytes: hex.EncodeToString(tr.Inst), A: r.AC, B: r.B, C: r.C,
+			SP: r.SP, Flags: r.Flags.String(), Cycles: tr.Cycles}
+		for _, w := range tr.Writes {
+			rec.Writes = append(rec.Writes, traceWrite{w.Addr, w.Value})
+		}
+		if tr.IRQ >= 0 {
+			rec.IRQ = &tr.IRQ
+		}
+		b, _ := json.Marshal(rec)
+		t.w.Write(b)
+		t.w.WriteByte('\n')
+		return
+	}
+
+	fmt.Fprintf(t.w, "%04x %-12s %-14s a=%02x b=%02x c=%02x sp=%04x fl=%s cyc=%d",
+		tr.PC, t.syms.Name(tr.PC), inst, r.AC, r.B, r.C, r.SP, r.Flags, tr.Cycles)
+	if src != "" {
+		fmt.Fprintf(t.w, " src=%s", src)
+	}
+	for _, w := range tr.Writes {
+		fmt.Fprintf(t.w, " [%04x]=%02x", w.Addr, w.Value)
+	}
+	if tr.IRQ >= 0 {
+		fmt.Fprintf(t.w, " irq=%d", tr.IRQ)
+	}
+	t.w.WriteByte('\n')
+}
+
+func (t *tracer) flush() error {
+	return t.w.Flush()
+}
+
+// traceFilter limits tracing to instructions within address ranges or
+// within symbols, that is between a symbol and the next one
+type traceFilter struct {
+	ranges [][2]uint16 // inclusive
+	names  map[string]bool
+}
+
+// parseTraceFilter parses a comma separated list of symbols, addresses and
+// address ranges in the form lo-hi
+func parseTraceFilter(spec string, syms *vm.AddressMap) (*traceFilter, error) {
+	f := &traceFilter{names: make(map[string]bool)}
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if _, ok := syms.Address(field); ok {
+			f.names[field] = true
+			continue
+		}
+		lo, hi := field, field
+		if i := strings.IndexByte(field, '-'); i > 0 {
+			lo, hi = field[:i], field[i+1:]
+		}
+		l, err := strconv.ParseUint(lo, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or unknown symbol: %s", lo)
+		}
+		h, err := strconv.ParseUint(hi, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or unknown symbol: %s", hi)
+		}
+		f.ranges = append(f.ranges, [2]uint16{uint16(l), uint16(h)})
+	}
+	return f, nil
+}
+
+func (f *traceFilter) match(addr uint16, syms *vm.AddressMap) bool {
+	for _, r := range f.ranges {
+		if addr >= r[0] && addr <= r[1] {
+			return true
+		}
+	}
+	name, _, ok := syms.Lookup(addr)
+	return ok && f.names[name]
+}
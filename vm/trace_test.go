@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestTraceFilter(t *testing.T) {
+	_, p := load(t, down)
+	syms := p.AddressMap()
+	var tests = []struct {
+		spec  string
+		match []uint16
+		skip  []uint16
+	}{
+		{"down", []uint16{0x0b, 0x0f, 0x11}, []uint16{0x0a, 0x12}},
+		{"0x5", []uint16{0x05}, []uint16{0x04, 0x06}},
+		{"2-0x8", []uint16{0x02, 0x05, 0x08}, []uint16{0x01, 0x09}},
+		{"done, 0-1", []uint16{0x00, 0x01, 0x12}, []uint16{0x02, 0x11}},
+	}
+	for _, test := range tests {
+		f, err := parseTraceFilter(test.spec, syms)
+		if err != nil {
+			t.Fatal(test.spec, err)
+		}
+		for _, addr := range test.match {
+			if !f.match(addr, syms) {
+				t.Errorf("%s: expected %04x to match", test.spec, addr)
+			}
+		}
+		for _, addr := range test.skip {
+			if f.match(addr, syms) {
+				t.Errorf("%s: expected %04x not to match", test.spec, addr)
+			}
+		}
+	}
+	for _, spec := range []string{"up", "1-up", "0x10000", ""} {
+		if _, err := parseTraceFilter(spec, syms); err == nil {
+			t.Errorf("%q: expected error", spec)
+		}
+	}
+}
+
+// trace runs the down program, tracing only the instructions spec matches
+func trace(t *testing.T, spec string, json bool) string {
+	c, p := load(t, down)
+	f, err := parseTraceFilter(spec, p.AddressMap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := new(bytes.Buffer)
+	tr := newTracer(b, p.AddressMap(), p.Lines(), json, f)
+	c.SetTracer(tr.trace)
+	if err := c.Run(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.flush(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestTraceText(t *testing.T) {
+	expect := "" +
+		"0005 main+5       call $down     a=03 b=01 c=00 sp=001b fl=----- cyc=36 src=test.a:6 [0019]=08 [001a]=00\n" +
+		"0008 main+8       mvi 7          a=07 b=01 c=00 sp=0019 fl=----- cyc=186 src=test.a:7\n" +
+		"000a main+10      ret            a=07 b=01 c=00 sp=0017 fl=----- cyc=196 src=test.a:8\n"
+	if s := trace(t, "5,0x8-0xa", false); s != expect {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expect, s)
+	}
+}
+
+func TestTraceJSON(t *testing.T) {
+	expect := `{"pc":0,"sym":"main","src":"test.a:3","inst":"mvi 1","bytes":"0801","a":1,"b":0,"c":0,"sp":25,"flags":"-----","cycles":7}
+{"pc":5,"sym":"main+5","src":"test.a:6","inst":"call $down","bytes":"04000b","a":3,"b":1,"c":0,"sp":27,"flags":"-----","cycles":36,"writes":[{"addr":25,"value":8},{"addr":26,"value":0}]}
+`
+	if s := trace(t, "0,5", true); s != expect {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expect, s)
+	}
+}
@@ -1,182 +1,50 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
+	"github.com/rthornton128/vm/cpu"
 	vm "github.com/rthornton128/vm/lib"
 )
 
-type CPU struct {
-	ar   uint16 // address register
-	dr   byte   // data register
-	ir   byte   // instruction register
-	pc   uint16 // program counter
-	sp   uint16 // stack pointer
-	tr   byte   // temporary register
-	ac   byte   // accumulator
-	b    byte   // register b
-	c    byte   // register c
-	zero bool   // zero flag
-	mem  Memory
-}
-
-func (c *CPU) init(ep, sp uint16, mem Memory) {
-	c.ac = 0 // redundant but extra assurrance
-	c.pc = ep
-	c.sp = sp
-	c.mem = mem
-	c.zero = true
-
-	// set return address on stack to invalid address
-	c.mem.Write(c.sp, 0xff)   // lsb
-	c.mem.Write(c.sp+1, 0xff) // msb
-	c.sp += 2
-}
-
-func (c *CPU) decode() {
-	switch vm.Opcode(c.ir & 0x3f) {
-	case vm.NOP:
-	case vm.CALL:
-	case vm.JMP, vm.JPZ, vm.JNZ:
-	case vm.RET:
-		c.sp--
-		c.ar = c.sp
-		c.dr = c.mem.Fetch(c.ar)
-		c.sp--
-		c.ar = c.sp
-	case vm.POP:
-		c.sp--
-		c.ar = c.sp
-	case vm.PUSH:
-		c.dr = c.ac
-		c.ar = c.sp
-		c.sp++
-	case vm.MVR:
-		c.dr = c.ac
-	case vm.MVI:
-	case vm.MOV, vm.ADD, vm.DIV, vm.MUL, vm.SHL, vm.SHR, vm.SUB, vm.AND, vm.OR:
-		switch vm.Register(c.ir & 0xc0) {
-		case vm.REGB:
-			c.dr = c.b
-		case vm.REGC:
-			c.dr = c.c
-		}
-	case vm.INC:
-		c.dr = 1
-	}
-}
-
-func (c *CPU) exec() {
-	switch vm.Opcode(c.ir & 0x3f) {
-	case vm.NOP:
-	case vm.JMP:
-		c.pc = c.ar
-	case vm.JPZ:
-		if c.zero {
-			c.pc = c.ar
-		}
-	case vm.JNZ:
-		if !c.zero {
-			c.pc = c.ar
-		}
-	case vm.CALL:
-		c.ar = c.sp
-		c.sp++
-		c.mem.Write(c.ar, uint8(c.pc))
-		c.ar = c.sp
-		c.sp++
-		c.mem.Write(c.ar, uint8(c.pc>>8))
-		c.pc = uint16(c.tr) << 8
-		c.pc |= uint16(c.dr)
-	case vm.RET:
-		c.pc = uint16(c.dr) << 8
-		c.dr = c.mem.Fetch(c.ar)
-		c.pc |= uint16(c.dr)
-	case vm.MOV:
-		c.ac = c.dr
-	case vm.MVR:
-		switch vm.Register(c.ir & 0xc0) {
-		case vm.REGB:
-			c.b = c.dr
-		case vm.REGC:
-			c.c = c.dr
-		}
-	case vm.MVI:
-		c.ac = c.dr
-	case vm.CLA:
-		c.ac = 0
-		c.zero = true
-	case vm.CLR:
-		c.ac = 0
-	case vm.POP:
-		c.dr = c.mem.Fetch(c.ar)
-		c.ac = c.dr
-	case vm.PUSH:
-		c.mem.Write(c.ar, c.dr)
-	case vm.ADD, vm.INC:
-		c.ac += c.dr
-	case vm.DIV:
-		c.ac /= c.dr
-	case vm.MUL:
-		c.ac *= c.dr
-	case vm.SHL:
-		c.ac <<= c.dr
-	case vm.SHR:
-		c.ac >>= c.dr
-	case vm.SUB:
-		c.ac -= c.dr
-	case vm.AND:
-		c.ac &= c.dr
-	case vm.OR:
-		c.ac |= c.dr
-	}
-}
-
-func (c *CPU) fetch() {
-	// cycle 1
-	c.ar = c.pc              // set address register to the program counter
-	c.pc++                   // advance the program counter
-	c.dr = c.mem.Fetch(c.ar) // fetch instruction into data register
-	c.ir = c.dr              // set the instruction register to the data register
-	//fmt.Println("c.ar:", c.ar, "c.ir:", c.ir)
-
-	switch vm.Opcode(c.ir) {
-	case vm.CALL: // cycle 2 and 3
-		// load address to jump to
-		c.dr = c.mem.Fetch(c.pc)
-		c.pc++
-		c.tr = c.dr
-		c.dr = c.mem.Fetch(c.pc)
-		c.pc++
-	case vm.JMP, vm.JPZ, vm.JNZ: // cycle 2 and 3
-		c.dr = c.mem.Fetch(c.pc)
-		c.ar = uint16(c.dr) << 8
-		c.pc++
-		c.dr = c.mem.Fetch(c.pc)
-		c.ar |= uint16(c.dr)
-		c.pc++
-	case vm.MVI: // cycle 2
-		c.dr = c.mem.Fetch(c.pc)
-		c.pc++
-	}
-}
-
-func (c *CPU) run() {
-	for {
-		c.fetch()
-		c.decode()
-		c.exec()
-		if c.pc == 0xffff {
-			break
-		}
-	}
-}
-
 func main() {
+	dbg := flag.Bool("debug", false, "run the program in the interactive debugger")
+	devs := flag.String("devices", "console=0xff00:0,timer=0xff04:1,random=0xff08",
+		"comma separated name=address[:irq] list of devices to map into "+
+			"memory, with the interrupt line each may raise")
+	seed := flag.Int64("seed", 0, "seed for the random device, the time if 0")
+	maxCycles := flag.Uint64("max-cycles", 0, "stop the program after `n` "+
+		"clock cycles, 0 for no limit")
+	clock := flag.String("clock", "", "throttle the CPU to a clock `speed` "+
+		"such as 2MHz, as fast as possible if not set")
+	profile := flag.String("profile", "", "write a pprof profile of the "+
+		"instructions and cycles executed by each function to `file`")
+	report := flag.String("profile-text", "", "write a report of the "+
+		"instructions and cycles executed by each function to `file`, - for "+
+		"standard error")
+	trace := flag.String("trace", "", "write a trace of each instruction "+
+		"executed to `file`, - for standard error")
+	traceJSON := flag.Bool("trace-json", false, "write the trace as JSON, "+
+		"one object per line")
+	traceOnly := flag.String("trace-only", "", "only trace instructions "+
+		"within a comma separated `list` of symbols and lo-hi address ranges")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: vm [flags] program.vm")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
 
 	f, err := os.Open(flag.Arg(0))
 	if err != nil {
@@ -194,11 +62,139 @@ func main() {
 		log.Fatal(err)
 	}
 
-	mem := NewBlock(0)
-	prog := p.SecTab[vm.TEXT]
-	mem.WriteBlock(0, prog)
-	cpu := new(CPU)
-	cpu.init(p.Entry, uint16(len(prog)), mem)
-	cpu.run()
-	log.Println("exit with result:", cpu.ac)
+	mem := cpu.NewBus(cpu.NewBlock(0))
+	c, err := cpu.New(p, mem)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the debugger reads its commands from standard input so the console
+	// has no input while debugging
+	in := io.Reader(os.Stdin)
+	if *dbg {
+		in = strings.NewReader("")
+	}
+	err = mapDevices(mem, *devs, c.Interrupts(), func(name string) (cpu.Device, error) {
+		return newDevice(name, *seed, in)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	syms, lines := p.AddressMap(), p.Lines()
+	if *dbg && len(p.SymTab) == 0 {
+		log.Print("program has no symbols, link it without -s to debug by name")
+	}
+	c.SetCycleLimit(*maxCycles)
+	if *clock != "" {
+		hz, err := parseClock(*clock)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.SetClock(hz)
+	}
+	if *dbg {
+		debug(c, syms, lines)
+		return
+	}
+
+	var hooks []func(*cpu.Trace)
+	var t *tracer
+	if *trace != "" {
+		var filter *traceFilter
+		if *traceOnly != "" {
+			if filter, err = parseTraceFilter(*traceOnly, syms); err != nil {
+				log.Fatal(err)
+			}
+		}
+		w := io.Writer(os.Stderr)
+		if *trace != "-" {
+			f, err := os.Create(*trace)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			w = f
+		}
+		t = newTracer(w, syms, lines, *traceJSON, filter)
+		hooks = append(hooks, t.trace)
+	}
+	var prof *profiler
+	if *profile != "" || *report != "" {
+		prof = newProfiler(syms, lines)
+		hooks = append(hooks, prof.record)
+	}
+	if len(hooks) > 0 {
+		c.SetTracer(func(tr *cpu.Trace) {
+			for _, h := range hooks {
+				h(tr)
+			}
+		})
+	}
+
+	err = c.Run(context.Background(), 0)
+	if t != nil {
+		if err := t.flush(); err != nil {
+			log.Println(err)
+		}
+	}
+	if prof != nil {
+		if err := writeProfile(prof, *profile, *report, flag.Arg(0)); err != nil {
+			log.Println(err)
+		}
+	}
+	if err == cpu.ErrCycleLimit {
+		log.Fatalf("stopped at %04x <%s> after %d cycles", c.PC(),
+			syms.Name(c.PC()), c.Cycles())
+	}
+	if err != nil {
+		c.Fault().Report(os.Stderr, syms, lines, mem)
+		os.Exit(1)
+	}
+	os.Exit(c.ExitCode())
+}
+
+// writeProfile writes the pprof profile and text report to the files
+// named, if any
+func writeProfile(p *profiler, pprof, report, program string) error {
+	if pprof != "" {
+		f, err := os.Create(pprof)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := p.writePprof(f, program); err != nil {
+			return err
+		}
+	}
+	if report == "-" {
+		p.report(os.Stderr)
+	} else if report != "" {
+		f, err := os.Create(report)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		p.report(f)
+	}
+	return nil
+}
+
+// parseClock parses a clock speed in hertz, optionally suffixed with Hz,
+// kHz or MHz
+func parseClock(s string) (int, error) {
+	n, mult := strings.ToLower(s), 1.0
+	for _, u := range []struct {
+		suffix string
+		mult   float64
+	}{{"mhz", 1e6}, {"khz", 1e3}, {"hz", 1}} {
+		if strings.HasSuffix(n, u.suffix) {
+			n, mult = strings.TrimSuffix(n, u.suffix), u.mult
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+	if err != nil || f*mult < 1 {
+		return 0, fmt.Errorf("invalid clock speed: %s", s)
+	}
+	return int(f * mult), nil
 }